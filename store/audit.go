@@ -0,0 +1,171 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const AUDITFILE = "audit.log"
+
+// auditRecord is a JSON line of audit log in store
+type auditRecord struct {
+	Time  string   `json:"time"`
+	User  string   `json:"user"`
+	Cmd   string   `json:"cmd"`
+	Names []string `json:"names,omitempty"`
+	Size  int64    `json:"size,omitempty"`
+}
+
+// auditUser returns identity of client, local user when store is used directly
+func (uri *URI) auditUser() string {
+	if uri.client != nil && uri.client.ident != "anonymous" {
+		return uri.client.ident
+	}
+	if os.Getenv("SSH_CONNECTION") != "" {
+		// login of ssh without forced command
+		return "ssh:" + os.Getenv("USER")
+	}
+	if uri.client != nil {
+		return "anonymous"
+	}
+	if user := os.Getenv("BFST_USER"); user != "" {
+		return "user:" + user
+	}
+	return "local:" + os.Getenv("USER")
+}
+
+// audit appends record of a change of store
+func (uri *URI) audit(cmd string, names []string, size int64) {
+	rec := auditRecord{time.Now().UTC().Format(time.RFC3339), uri.auditUser(), cmd, names, size}
+	bs, _ := json.Marshal(rec)
+	f, err := os.OpenFile(uri.path+"/"+AUDITFILE, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		Warn("audit " + err.Error())
+		return
+	}
+	defer f.Close()
+	f.Write(append(bs, '\n'))
+}
+
+type auditFilter struct {
+	user, cmd string
+	since     time.Time
+	names     []*regexp.Regexp
+}
+
+// parseAuditFilter parses [--user U] [--cmd C] [--since TIME] [name filters]
+func parseAuditFilter(flags []string) (*auditFilter, error) {
+	af := &auditFilter{}
+	var names []string
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		if f == "" {
+			continue
+		}
+		if !strings.HasPrefix(f, "--") {
+			names = append(names, f)
+			continue
+		}
+		if i+1 >= len(flags) {
+			return nil, errors.New("log needs value of " + f)
+		}
+		i++
+		switch f {
+		case "--user":
+			af.user = flags[i]
+		case "--cmd":
+			af.cmd = flags[i]
+		case "--since":
+			var err error
+			af.since, err = time.Parse(time.RFC3339, flags[i])
+			if err != nil {
+				af.since, err = time.Parse("2006-01-02", flags[i])
+			}
+			if err != nil {
+				return nil, errors.New("invalid time " + flags[i])
+			}
+		default:
+			return nil, errors.New("unknown option " + f)
+		}
+	}
+	var err error
+	af.names, err = filterRegexps(names)
+	if err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+func (af *auditFilter) match(rec *auditRecord) bool {
+	if af.user != "" && rec.User != af.user && !strings.HasSuffix(rec.User, ":"+af.user) {
+		return false
+	}
+	if af.cmd != "" && rec.Cmd != af.cmd {
+		return false
+	}
+	if !af.since.IsZero() {
+		tm, err := time.Parse(time.RFC3339, rec.Time)
+		if err != nil || tm.Before(af.since) {
+			return false
+		}
+	}
+	if len(af.names) == 0 {
+		return true
+	}
+	for _, name := range rec.Names {
+		for _, r := range af.names {
+			if r.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// localLog returns records of audit log which match flags, --json selects JSON lines
+func (uri *URI) localLog(flags []string) ([]byte, error) {
+	asJSON := false
+	var rest []string
+	for _, f := range flags {
+		if f == "--json" {
+			asJSON = true
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	af, err := parseAuditFilter(rest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(uri.path + "/" + AUDITFILE)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxRequest)
+	for scanner.Scan() {
+		rec := &auditRecord{}
+		if json.Unmarshal(scanner.Bytes(), rec) != nil || !af.match(rec) {
+			continue
+		}
+		if asJSON {
+			ret = append(ret, scanner.Bytes()...)
+			ret = append(ret, '\n')
+		} else {
+			ret = append(ret, fmt.Sprintf("%s %-20s %-8s %-12d %s\n", rec.Time, rec.User, rec.Cmd, rec.Size, strings.Join(rec.Names, " "))...)
+		}
+	}
+	return ret, scanner.Err()
+}
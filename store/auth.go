@@ -0,0 +1,222 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const ACCESSFILE = "access"
+
+var ErrPermission = errors.New("permission denied")
+
+// permissions, each one includes permissions before it
+var perms = []string{"read", "put", "admin"}
+
+// permission needed by remote commands, hello and auth are always allowed
+var cmdPerms = map[string]string{
+	"ls":         "read",
+	"getIndex":   "read",
+	"getBlock":   "read",
+	"stats":      "read",
+	"hasBlocks":  "read",
+	"index":      "read",
+	"quota":      "read",
+	"putBlock":   "put",
+	"putBlockID": "put",
+	"putIndex":   "put",
+	"rm":         "admin",
+	"log":        "admin",
+}
+
+// grant is a line of access file in store
+//
+//	# identity         perm   [name prefix]
+//	token:<sha256 of token>  admin
+//	cert:backup-host   read
+//	user:ci            put    ci-
+//	anonymous          read
+type grant struct {
+	perm, prefix string
+}
+
+// client is identity of a connected client and its grant, grant is nil when store has no access file
+type client struct {
+	ident string
+	grant *grant
+
+	// visible blocks of prefix, computed once per changes of files
+	visible        map[string]bool
+	visibleChanges int
+}
+
+func readAccess(path string) (map[string]*grant, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	grants := make(map[string]*grant)
+	for i, line := range strings.Split(string(bs), "\n") {
+		ts := strings.Fields(line)
+		if len(ts) == 0 || ts[0][0] == '#' {
+			continue
+		}
+		if len(ts) > 3 || len(ts) < 2 || permLevel(ts[1]) < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line", path, i+1)
+		}
+		g := &grant{perm: ts[1]}
+		if len(ts) == 3 {
+			g.prefix = ts[2]
+		}
+		grants[ts[0]] = g
+	}
+	return grants, nil
+}
+
+func permLevel(perm string) int {
+	for i, p := range perms {
+		if p == perm {
+			return i
+		}
+	}
+	return -1
+}
+
+func tokenIdent(token string) string {
+	rhash := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(rhash[:])
+}
+
+// authorize sets identity of client, store without access file allows all
+func (uri *URI) authorize(ident string) error {
+	if ident == "" {
+		ident = "anonymous"
+	}
+	grants, err := readAccess(uri.path + "/" + ACCESSFILE)
+	if os.IsNotExist(err) {
+		uri.client = &client{ident: ident}
+		return nil
+	}
+	if err != nil {
+		uri.client = &client{ident: ident, grant: &grant{}}
+		return err
+	}
+	g, ok := grants[ident]
+	if !ok {
+		uri.client = &client{ident: ident, grant: &grant{}}
+		return ErrPermission
+	}
+	uri.client = &client{ident: ident, grant: g}
+	return nil
+}
+
+// auth is auth command, token replaces identity of connection
+func (uri *URI) auth(token string) ([]byte, error) {
+	ident := tokenIdent(token)
+	err := uri.authorize(ident)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(ident), nil
+}
+
+// allow checks permission of remote command
+func (uri *URI) allow(cmd string, data []byte) error {
+	perm, ok := cmdPerms[cmd]
+	if !ok || uri.client == nil || uri.client.grant == nil {
+		return nil
+	}
+	g := uri.client.grant
+	if permLevel(g.perm) < permLevel(perm) {
+		return ErrPermission
+	}
+	if cmd == "putIndex" && !strings.HasPrefix(string(data), g.prefix) {
+		return ErrPermission
+	}
+	return nil
+}
+
+// inPrefix returns true when name is visible to client
+func (uri *URI) inPrefix(name string) bool {
+	return uri.client == nil || uri.client.grant == nil || strings.HasPrefix(name, uri.client.grant.prefix)
+}
+
+// visibleBlocks returns blocks of files visible to client, it is nil when client
+// sees all blocks. Shards of ec descriptors in files are visible too.
+func (uri *URI) visibleBlocks() (map[string]bool, error) {
+	if uri.client == nil || uri.client.grant == nil || uri.client.grant.prefix == "" {
+		return nil, nil
+	}
+	changes := 0
+	if uri.shared != nil {
+		uri.shared.mu.Lock()
+		changes = uri.shared.changes
+		uri.shared.mu.Unlock()
+	}
+	if uri.client.visible != nil && uri.client.visibleChanges == changes {
+		uri.metrics.cache("visible", true)
+		return uri.client.visible, nil
+	}
+	uri.metrics.cache("visible", false)
+	index, err := uri.allIndex()
+	if err != nil {
+		return nil, err
+	}
+	files, err := uri.localListFiles(nil)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for _, file := range files {
+		for _, hash := range file.blocks {
+			ret[hash] = true
+			if index[hash] > ecDescMax {
+				continue
+			}
+			bs, err := uri.getBlock(hash)
+			if err != nil || !bytes.HasPrefix(bs, []byte("ec ")) {
+				continue
+			}
+			st, err := parseStripe(idAlgo(hash), bs)
+			if err == nil {
+				for _, shard := range st.shards {
+					ret[shard] = true
+				}
+			}
+		}
+	}
+	uri.client.visible, uri.client.visibleChanges = ret, changes
+	return ret, nil
+}
+
+// allowBlock checks that block is visible to client
+func (uri *URI) allowBlock(hash string) error {
+	visible, err := uri.visibleBlocks()
+	if err != nil {
+		return err
+	}
+	if visible != nil && !visible[hash] {
+		return ErrPermission
+	}
+	return nil
+}
+
+// visibleIndex returns blocks of index which are visible to client
+func (uri *URI) visibleIndex(index map[string]int) (map[string]int, error) {
+	visible, err := uri.visibleBlocks()
+	if visible == nil || err != nil {
+		return index, err
+	}
+	ret := make(map[string]int)
+	for hash, sz := range index {
+		if visible[hash] {
+			ret[hash] = sz
+		}
+	}
+	return ret, nil
+}
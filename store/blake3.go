@@ -0,0 +1,131 @@
+package store
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// BLAKE3 with 32 bytes output, hash mode only
+
+const (
+	b3ChunkStart = 1 << 0
+	b3ChunkEnd   = 1 << 1
+	b3Parent     = 1 << 2
+	b3Root       = 1 << 3
+	b3ChunkLen   = 1024
+	b3BlockLen   = 64
+)
+
+var b3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var b3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func b3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] = s[a] + s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] = s[a] + s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func b3Compress(cv *[8]uint32, m [16]uint32, counter uint64, blen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		b3IV[0], b3IV[1], b3IV[2], b3IV[3], uint32(counter), uint32(counter >> 32), blen, flags,
+	}
+	for r := 0; r < 7; r++ {
+		b3G(&s, 0, 4, 8, 12, m[0], m[1])
+		b3G(&s, 1, 5, 9, 13, m[2], m[3])
+		b3G(&s, 2, 6, 10, 14, m[4], m[5])
+		b3G(&s, 3, 7, 11, 15, m[6], m[7])
+		b3G(&s, 0, 5, 10, 15, m[8], m[9])
+		b3G(&s, 1, 6, 11, 12, m[10], m[11])
+		b3G(&s, 2, 7, 8, 13, m[12], m[13])
+		b3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var p [16]uint32
+		for i := range p {
+			p[i] = m[b3Permutation[i]]
+		}
+		m = p
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+// b3Node is input of a compression which is not done yet, last one gets root flag
+type b3Node struct {
+	cv      [8]uint32
+	m       [16]uint32
+	counter uint64
+	blen    uint32
+	flags   uint32
+}
+
+func (n *b3Node) chainingValue() (cv [8]uint32) {
+	s := b3Compress(&n.cv, n.m, n.counter, n.blen, n.flags)
+	copy(cv[:], s[:8])
+	return
+}
+
+func b3Words(block []byte) (m [16]uint32) {
+	var buf [b3BlockLen]byte
+	copy(buf[:], block)
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return
+}
+
+// b3Chunk returns node of last block of chunk
+func b3Chunk(chunk []byte, counter uint64) *b3Node {
+	cv := b3IV
+	flags := uint32(b3ChunkStart)
+	for len(chunk) > b3BlockLen {
+		s := b3Compress(&cv, b3Words(chunk[:b3BlockLen]), counter, b3BlockLen, flags)
+		copy(cv[:], s[:8])
+		chunk = chunk[b3BlockLen:]
+		flags = 0
+	}
+	return &b3Node{cv, b3Words(chunk), counter, uint32(len(chunk)), flags | b3ChunkEnd}
+}
+
+func b3ParentNode(left, right [8]uint32) *b3Node {
+	var m [16]uint32
+	copy(m[:8], left[:])
+	copy(m[8:], right[:])
+	return &b3Node{b3IV, m, 0, b3BlockLen, b3Parent}
+}
+
+func blake3Sum(data []byte) (ret [32]byte) {
+	// stack of chaining values of complete subtrees
+	var stack [][8]uint32
+	var counter uint64
+	for len(data) > b3ChunkLen {
+		cv := b3Chunk(data[:b3ChunkLen], counter).chainingValue()
+		data = data[b3ChunkLen:]
+		counter++
+		// merge subtrees while count of chunks is even
+		for total := counter; total&1 == 0; total >>= 1 {
+			cv = b3ParentNode(stack[len(stack)-1], cv).chainingValue()
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, cv)
+	}
+	node := b3Chunk(data, counter)
+	for i := len(stack) - 1; i >= 0; i-- {
+		node = b3ParentNode(stack[i], node.chainingValue())
+	}
+	s := b3Compress(&node.cv, node.m, node.counter, node.blen, node.flags|b3Root)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(ret[i*4:], s[i])
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// HASHFILE selects hash of new blocks in store, sha256 without it
+const HASHFILE = "hash"
+
+var ErrUnknownHash = errors.New("unknown hash algorithm")
+
+// hashPrefixes are multihash prefixes of block ids, hash code and digest length in hex.
+// sha256 ids have no prefix, so blocks of old stores keep their ids.
+var hashPrefixes = map[string]string{
+	"sha256": "",
+	"blake3": "1e20",
+}
+
+func hashSum(algo string, data []byte) []byte {
+	switch algo {
+	case "blake3":
+		rhash := blake3Sum(data)
+		return rhash[:]
+	default:
+		rhash := sha256.Sum256(data)
+		return rhash[:]
+	}
+}
+
+// blockID returns id of block, it is prefix and hex digest
+func blockID(algo string, data []byte) string {
+	return hashPrefixes[algo] + hex.EncodeToString(hashSum(algo, data))
+}
+
+// idAlgo returns hash algorithm of block id, "" when it is no block id
+func idAlgo(id string) string {
+	for algo, prefix := range hashPrefixes {
+		if len(id) == len(prefix)+64 && strings.HasPrefix(id, prefix) {
+			return algo
+		}
+	}
+	return ""
+}
+
+// checkBlock checks data of block with its id
+func checkBlock(id string, data []byte) error {
+	algo := idAlgo(id)
+	if algo == "" {
+		return fmt.Errorf("%q %w", id, ErrInvalidHash)
+	}
+	if blockID(algo, data) != id {
+		return fmt.Errorf("block %s %w", id, ErrChecksum)
+	}
+	return nil
+}
+
+// blockPath returns directory and file name of block in store,
+// sha256 blocks are in ab/cd/ef.. and other blocks in prefix/ab/cd/ef..
+func blockPath(id string) (string, string) {
+	prefix := hashPrefixes[idAlgo(id)]
+	hash := id[len(prefix):]
+	dir := hash[:2] + "/" + hash[2:4]
+	if prefix != "" {
+		dir = prefix + "/" + dir
+	}
+	return dir, hash[4:]
+}
+
+func validAlgo(algo string) error {
+	if _, ok := hashPrefixes[algo]; !ok {
+		return fmt.Errorf("%s %w", algo, ErrUnknownHash)
+	}
+	return nil
+}
+
+// hashAlgo returns hash algorithm of new blocks in store
+func (uri *URI) hashAlgo() string {
+	if uri.algo != "" {
+		return uri.algo
+	}
+	switch uri.proto {
+	case "ssh", "tls":
+		if uri.stdin == nil {
+			uri.open()
+		}
+	case "file":
+		bs, err := ioutil.ReadFile(uri.path + "/" + HASHFILE)
+		if err == nil {
+			uri.algo = strings.TrimSpace(string(bs))
+		} else if !os.IsNotExist(err) {
+			Warn(err.Error())
+		}
+	case "mirror", "ec":
+		// replicas have the same hash, blocks are found by id
+		if len(uri.replicas) > 0 {
+			uri.algo = uri.replicas[0].hashAlgo()
+		}
+	}
+	if uri.algo == "" {
+		return "sha256"
+	}
+	return uri.algo
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// goArch maps output of uname -sm to GOOS and GOARCH
+func goArch(uname string) (string, string, error) {
+	ts := strings.Fields(uname)
+	if len(ts) != 2 {
+		return "", "", errors.New("invalid uname " + uname)
+	}
+	goos := strings.ToLower(ts[0])
+	if goos != "linux" && goos != "darwin" && goos != "freebsd" && goos != "openbsd" && goos != "netbsd" {
+		return "", "", errors.New("unknown os " + ts[0])
+	}
+	switch ts[1] {
+	case "x86_64", "amd64":
+		return goos, "amd64", nil
+	case "aarch64", "arm64":
+		return goos, "arm64", nil
+	case "i386", "i486", "i586", "i686":
+		return goos, "386", nil
+	case "riscv64", "ppc64le", "s390x", "mips64", "mips64le":
+		return goos, ts[1], nil
+	}
+	if strings.HasPrefix(ts[1], "armv") {
+		return goos, "arm", nil
+	}
+	return "", "", errors.New("unknown arch " + ts[1])
+}
+
+// bfstBinary returns bfst for goos/goarch, bfst-goos-goarch is searched
+// in bindir, directory of running bfst and current directory.
+// running bfst is used when it has same os and arch.
+func (uri *URI) bfstBinary(goos, goarch string) ([]byte, error) {
+	name := "bfst-" + goos + "-" + goarch
+	exe, err := os.Executable()
+	var dirs []string
+	if uri.bindir != "" {
+		dirs = append(dirs, uri.bindir)
+	}
+	if err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	dirs = append(dirs, ".")
+	for _, dir := range dirs {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return bs, nil
+		}
+	}
+	if goos == runtime.GOOS && goarch == runtime.GOARCH && err == nil {
+		return ioutil.ReadFile(exe)
+	}
+	return nil, errors.New("no " + name + " in " + strings.Join(dirs, " "))
+}
+
+// remoteBinary returns bfst which runs on remote host
+func (uri *URI) remoteBinary() ([]byte, error) {
+	ret, err := uri.runSSH("uname -sm", nil)
+	if err != nil {
+		return nil, errors.New("uname failed: " + err.Error())
+	}
+	goos, goarch, err := goArch(string(ret))
+	if err != nil {
+		return nil, err
+	}
+	return uri.bfstBinary(goos, goarch)
+}
+
+// exeInfo returns sha256 and os/arch of running bfst
+func exeInfo() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	bs, err := ioutil.ReadFile(exe)
+	if err != nil {
+		return ""
+	}
+	rhash := sha256.Sum256(bs)
+	return hex.EncodeToString(rhash[:]) + " " + runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// putBinary uploads bfst to bfst.new, checks sha256 and renames it to bfst
+func (uri *URI) putBinary(elf []byte) error {
+	ret, err := uri.runSSH("cat >bfst.new && chmod 755 bfst.new && sha256sum bfst.new", elf)
+	if err != nil {
+		return errors.New("put bfst error")
+	}
+	rhash := sha256.Sum256(elf)
+	if strings.Index(string(ret), hex.EncodeToString(rhash[:])) < 0 {
+		uri.runSSH("rm -f bfst.new", nil)
+		return errors.New("verify bfst error")
+	}
+	_, err = uri.runSSH("mv -f bfst.new bfst", nil)
+	return err
+}
+
+// upgrade puts bfst when remote bfst differs from bfst of its os/arch here
+// and it is older, it returns true when remote bfst is replaced.
+// bfst-os-arch of bindir is taken to have the version of this bfst.
+func (uri *URI) upgrade() (bool, error) {
+	if uri.exeVersion != "" && !versionLess(uri.exeVersion, Version) {
+		return false, nil
+	}
+	var elf []byte
+	var err error
+	ts := strings.Fields(uri.exe)
+	if len(ts) == 2 && strings.Count(ts[1], "/") == 1 {
+		n := strings.Index(ts[1], "/")
+		elf, err = uri.bfstBinary(ts[1][:n], ts[1][n+1:])
+	} else {
+		// bfst before hello command does not report itself
+		elf, err = uri.remoteBinary()
+	}
+	if err != nil {
+		return false, err
+	}
+	rhash := sha256.Sum256(elf)
+	if len(ts) > 0 && ts[0] == hex.EncodeToString(rhash[:]) {
+		return false, nil
+	}
+	if uri.exeVersion != "" {
+		Warn("upgrade remote bfst " + uri.exeVersion + " to " + Version)
+	} else {
+		Warn("upgrade remote bfst to " + Version)
+	}
+	uri.close()
+	return true, uri.putBinary(elf)
+}
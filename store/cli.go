@@ -0,0 +1,251 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+const usage = `Usage:
+bfst indexfile
+bfst user@host[:port][/path] [subcommands]
+bfst tls://host[:port] [subcommands]
+bfst "mirror:(uri1,uri2[,quorum=N])" [subcommands]
+bfst "ec:(uri1,uri2,uri3[,parity=M][,quorum=N])" [subcommands]
+bfst @name [subcommands], name is a remote in ~/.config/bfst/config
+bfst sync src_uri dst_uri [--delete] [filter1 filter2 ...]
+bfst serve [--listen :7700] [--store path] --cert cert.pem --key key.pem [--client-ca ca.pem] [--metrics :9770]
+bfst keygen [keyfile], writes ed25519 sign key (default ~/.config/bfst/sign.key) and prints its public key
+options =
+  --json              JSON Lines output, progress and errors go to stderr
+  --limit-rate RATE   limit transfer rate, like 10M or 08:00-18:00=10M,0
+subcommands = 
+  init [--hash sha256|blake3]
+  ls [filter1 filter2 ...]
+  rm file1 [file2 ...]
+  stats [filter1 filter2 ...]
+  quota
+  log [--user U] [--cmd putIndex|rm|init] [--since TIME] [filter1 ...]
+  get file1 [file2 ...]
+  put file1 [file2 ...]
+  diff localfile [storedname]
+  cat [--range off:len] file
+  serve-files [--listen addr]
+  index file1 [file2 ...]
+`
+
+// Main runs bfst command line, it returns exit code
+func Main(args []string) int {
+	var rest []string
+	var limiter *rateLimiter
+	out := textOutput
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--json":
+			out = jsonOutput
+		case "--limit-rate":
+			var err error
+			if i+1 < len(args) {
+				i++
+				limiter, err = parseRate(args[i])
+			}
+			if limiter == nil {
+				if err == nil {
+					err = errors.New("--limit-rate needs rate")
+				}
+				out.printFatal(err)
+				return 1
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	args = rest
+	Warn = out.printWarning
+
+	if len(args) == 3 && args[1] == ".init" {
+		// init of remote store with hash of new blocks
+		uri := parseURI("file:.")
+		uri.algo = args[2]
+		uri.out = out
+		err := uri.init()
+		if err != nil {
+			out.printFatal(err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(args) == 2 && args[1][0] == '.' {
+		uri := parseURI("file:.")
+		uri.out = out
+		if args[1] == ".init" {
+			uri.init()
+		} else {
+			uri.remote()
+		}
+		return 0
+	}
+
+	if len(args) >= 2 && len(args) <= 3 && args[1] == "keygen" {
+		err := cmdKeygen(args[2:])
+		if err != nil {
+			out.printFatal(err)
+			return 3
+		}
+		return 0
+	}
+
+	if len(args) < 3 {
+		print(usage)
+		return 1
+	}
+
+	if args[1] == "serve" {
+		err := cmdServe(args[2:])
+		if err != nil {
+			out.printFatal(err)
+			return 3
+		}
+		return 0
+	}
+
+	if args[1] == "sync" {
+		var filter []string
+		del := false
+		for _, arg := range args[3:] {
+			if arg == "--delete" {
+				del = true
+			} else {
+				filter = append(filter, arg)
+			}
+		}
+		if len(filter) == 0 {
+			print(usage)
+			return 1
+		}
+		src := parseURI(args[2])
+		dst := parseURI(filter[0])
+		if src == nil || dst == nil {
+			out.printFatal(ErrInvalidURI)
+			return 2
+		}
+		if limiter != nil {
+			src.limiter = limiter
+			dst.limiter = limiter
+		}
+		src.out, dst.out = out, out
+		err := cmdSync(src, dst, filter[1:], del)
+		if err != nil {
+			out.printFatal(err)
+			return 3
+		}
+		return 0
+	}
+
+	uri := parseURI(args[1])
+	if uri == nil {
+		out.printFatal(ErrInvalidURI)
+		return 2
+	}
+	if limiter != nil {
+		uri.limiter = limiter
+	}
+	uri.out = out
+
+	var err error
+	switch args[2] {
+	case "init":
+		if len(args) == 5 && args[3] == "--hash" {
+			uri.algo = args[4]
+			err = validAlgo(uri.algo)
+		} else if len(args) != 3 {
+			print(usage)
+			return 1
+		}
+		if err == nil {
+			err = uri.init()
+		}
+		if err == nil && out == jsonOutput {
+			printJSON(os.Stdout, initJSON{uri.str(), uri.algo})
+		}
+	case "ls", "dir":
+		if out == jsonOutput {
+			var bs []byte
+			bs, err = uri.getIndex(args[3:])
+			for _, file := range getFiles(strings.Split(string(bs), "\n")) {
+				printJSON(os.Stdout, newFileJSON(file))
+			}
+		} else {
+			var bs []byte
+			bs, err = uri.ls(args[3:])
+			if len(bs) > 0 {
+				print(string(bs))
+			}
+		}
+	case "stats", "du":
+		{
+			flags := args[3:]
+			if out == jsonOutput {
+				flags = append(flags, "--json")
+			}
+			var bs []byte
+			bs, err = uri.stats(flags)
+			out.printResult(bs)
+		}
+	case "put":
+		err = uri.cmdPut(args[3:], false)
+	case "get":
+		err = uri.cmdGet(args[3:])
+	case "serve-files":
+		err = uri.cmdServeFiles(args[3:])
+	case "cat":
+		err = uri.cmdCat(args[3:])
+	case "diff":
+		if len(args) < 4 || len(args) > 5 {
+			print(usage)
+			return 1
+		}
+		name := ""
+		if len(args) == 5 {
+			name = args[4]
+		}
+		err = uri.cmdDiff(args[3], name)
+	case "log":
+		{
+			flags := args[3:]
+			if out == jsonOutput {
+				flags = append(flags, "--json")
+			}
+			var bs []byte
+			bs, err = uri.log(flags)
+			out.printResult(bs)
+		}
+	case "quota":
+		var flags []string
+		if out == jsonOutput {
+			flags = append(flags, "--json")
+		}
+		var bs []byte
+		bs, err = uri.quota(flags)
+		out.printResult(bs)
+	case "rm":
+		{
+			var bs []byte
+			bs, err = uri.rm(args[3:])
+			out.printRemoved(bs)
+		}
+	default:
+		if strings.LastIndex(args[2], ".idx") == len(args[2])-4 {
+			err = uri.cmdUpdate(args[2])
+		} else {
+			print(usage)
+			return 1
+		}
+	}
+	if err != nil {
+		out.printFatal(err)
+		return 3
+	}
+	return 0
+}
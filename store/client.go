@@ -0,0 +1,208 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidURI  = errors.New("invalid URI")
+	ErrInvalidName = errors.New("invalid name")
+	ErrNotFound    = errors.New("not found")
+	ErrNoIndex     = errors.New("no index")
+	ErrChecksum    = errors.New("checksum error")
+)
+
+// Warn reports errors which are recovered, like a failed replica or a retry.
+// It does nothing by default, bfst command line prints them.
+var Warn = func(msg string) {}
+
+// warnWriter passes lines written to it to Warn, like stderr of ssh
+type warnWriter struct{}
+
+func (warnWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		Warn(line)
+	}
+	return len(p), nil
+}
+
+// RemoteError is an error reported by remote bfst
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Msg
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Blocks  []string
+}
+
+// Progress of a file transfer, Blocks is 0 when size is unknown
+type Progress struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Blocks  int    `json:"blocks"`
+	Done    int    `json:"done"`    // blocks done
+	Skipped int    `json:"skipped"` // blocks which are already stored
+	Bytes   int64  `json:"bytes"`   // bytes transferred
+	Deduped int64  `json:"deduped"` // bytes not transferred because blocks are already stored
+}
+
+// Client accesses a file store, it is not safe for concurrent use
+type Client struct {
+	uri *URI
+
+	// Progress is called after each block of Put and Get
+	Progress func(Progress)
+}
+
+// Open returns client of store uri, connection is made on first request
+//
+//	user@host[:port][/path]
+//	file:path
+//	mirror:(uri1,uri2,...)
+//	ec:(uri1,uri2,uri3,parity=1)
+func Open(uri string) (*Client, error) {
+	u := parseURI(uri)
+	if u == nil {
+		return nil, ErrInvalidURI
+	}
+	return &Client{uri: u}, nil
+}
+
+// SetRate limits transfer rate of Put and Get, like 10M or 08:00-18:00=10M,0
+func (c *Client) SetRate(rate string) error {
+	l, err := parseRate(rate)
+	if err != nil {
+		return err
+	}
+	c.uri.limiter = l
+	return nil
+}
+
+// Close closes connections to remote store
+func (c *Client) Close() {
+	c.uri.closeAll()
+}
+
+func (c *Client) progress(p *Progress) {
+	if c.Progress != nil {
+		c.Progress(*p)
+	}
+}
+
+// Put stores content of r as name, blocks which are already stored are not sent
+func (c *Client) Put(ctx context.Context, name string, r io.Reader) error {
+	c.uri.setContext(ctx)
+	defer c.uri.setContext(nil)
+	err := validName(name)
+	if err != nil {
+		return err
+	}
+	index, err := c.uri.allIndex()
+	if err != nil {
+		return err
+	}
+	lines, err := c.uri.putFile(ctx, name, 0, time.Now(), r, index, c.progress)
+	if err != nil {
+		return err
+	}
+	if len(indexBlocks(lines[1:])) == 0 {
+		return errors.New("empty file")
+	}
+	return c.uri.putIndex(lines)
+}
+
+// Get writes content of stored file name to w, every block is verified
+func (c *Client) Get(ctx context.Context, name string, w io.Writer) error {
+	c.uri.setContext(ctx)
+	defer c.uri.setContext(nil)
+	fi, err := c.uri.stat(name)
+	if err != nil {
+		return err
+	}
+	err = c.uri.verify(fi)
+	if err != nil {
+		return err
+	}
+	return fi.write(ctx, c.uri, w, c.progress)
+}
+
+// Open returns reader of stored file name and its size, blocks are read and
+// verified when they are needed. Reads fail when ctx is done. Reads of the
+// reader may be concurrent, but not with other methods of the client.
+func (c *Client) Open(ctx context.Context, name string) (io.ReaderAt, int64, error) {
+	c.uri.setContext(ctx)
+	defer c.uri.setContext(nil)
+	r, err := c.uri.openFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.ctx = ctx
+	return r, r.Size(), nil
+}
+
+// List returns stored files matching filters, a filter is glob or /regexp/
+func (c *Client) List(ctx context.Context, filters ...string) ([]FileInfo, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	c.uri.setContext(ctx)
+	defer c.uri.setContext(nil)
+	ret, err := c.uri.getIndex(filters)
+	if err != nil {
+		return nil, err
+	}
+	var result []FileInfo
+	for _, fi := range getFiles(strings.Split(string(ret), "\n")) {
+		result = append(result, FileInfo{fi.name, c.uri.plainSize(fi.size, len(fi.blocks)), fi.mtime, fi.blocks})
+	}
+	return result, nil
+}
+
+// Stat returns information of stored file name
+func (c *Client) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	c.uri.setContext(ctx)
+	defer c.uri.setContext(nil)
+	fi, err := c.uri.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{fi.name, c.uri.plainSize(fi.size, len(fi.blocks)), fi.mtime, fi.blocks}, nil
+}
+
+// Remove removes stored files, blocks are kept
+func (c *Client) Remove(ctx context.Context, names ...string) error {
+	c.uri.setContext(ctx)
+	defer c.uri.setContext(nil)
+	for _, name := range names {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		ret, err := c.uri.rm([]string{nameFilter(name)})
+		if err != nil {
+			return err
+		}
+		if len(ret) == 0 {
+			return fmt.Errorf("%s %w", name, ErrNotFound)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configPath returns path of config file, BFST_CONFIG overrides default path
+func configPath() string {
+	path := os.Getenv("BFST_CONFIG")
+	if path != "" {
+		return path
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = os.Getenv("HOME") + "/.config"
+	}
+	return dir + "/bfst/config"
+}
+
+// readConfig reads ini style config file
+//
+//	# keys before first section are defaults of all remotes
+//	cachedir = ~/.cache/bfst
+//	[prod]
+//	uri = user@host/some/long/path
+//	port = 2222
+func readConfig(path string) (map[string]map[string]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := map[string]map[string]string{"": {}}
+	section := ""
+	for i, line := range strings.Split(string(bs), "\n") {
+		line = strings.Trim(line, " \t\r")
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if conf[section] == nil {
+				conf[section] = make(map[string]string)
+			}
+			continue
+		}
+		n := strings.Index(line, "=")
+		if n < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line", path, i+1)
+		}
+		conf[section][strings.TrimSpace(line[:n])] = strings.TrimSpace(line[n+1:])
+	}
+	return conf, nil
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return os.Getenv("HOME") + path[1:]
+	}
+	return path
+}
+
+func parseBool(str string) (bool, error) {
+	switch strings.ToLower(str) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	}
+	return false, errors.New("invalid boolean " + str)
+}
+
+// configURI returns URI of named remote in config file
+func configURI(name string) (*URI, error) {
+	path := configPath()
+	conf, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	section, ok := conf[name]
+	if name == "" || !ok {
+		return nil, fmt.Errorf("%s: no remote @%s", path, name)
+	}
+	values := make(map[string]string)
+	for k, v := range conf[""] {
+		values[k] = v
+	}
+	for k, v := range section {
+		values[k] = v
+	}
+
+	if values["uri"] == "" || values["uri"][0] == '@' {
+		return nil, fmt.Errorf("%s: @%s has no uri", path, name)
+	}
+	uri := parseURI(values["uri"])
+	if uri == nil {
+		return nil, fmt.Errorf("%s: @%s has invalid uri", path, name)
+	}
+	err = uri.configure(values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: @%s %s", path, name, err.Error())
+	}
+	return uri, nil
+}
+
+// configure applies settings of a remote
+func (uri *URI) configure(values map[string]string) error {
+	for k, v := range values {
+		var err error
+		switch k {
+		case "uri":
+		case "user":
+			uri.user = v
+		case "host":
+			uri.host = v
+		case "port":
+			uri.port = v
+		case "path":
+			uri.path = v
+		case "identity":
+			uri.identity = expandHome(v)
+		case "compression":
+			var b bool
+			b, err = parseBool(v)
+			uri.nocompress = !b
+		case "cachedir":
+			uri.cachedir = expandHome(v)
+		case "ca":
+			uri.ca = expandHome(v)
+		case "cert":
+			uri.cert = expandHome(v)
+		case "key":
+			uri.key = expandHome(v)
+		case "token":
+			uri.token = v
+		case "sign-key":
+			uri.signkey = expandHome(v)
+		case "trusted-keys":
+			uri.trusted = expandHome(v)
+		case "bindir":
+			uri.bindir = expandHome(v)
+		case "auto-upgrade":
+			var b bool
+			b, err = parseBool(v)
+			uri.noupgrade = !b
+		case "limit-rate":
+			uri.limiter, err = parseRate(v)
+		case "retries", "retry-backoff", "retry-max-backoff", "timeout", "min-rate", "hello-timeout":
+			err = uri.retryPolicy().configure(k, v)
+		case "concurrency":
+			uri.concurrency, err = strconv.Atoi(v)
+			if err != nil || uri.concurrency < 1 {
+				err = errors.New("invalid concurrency " + v)
+			}
+		case "encryption-key":
+			uri.cipher, err = readEncryptionKey(expandHome(v))
+		default:
+			err = errors.New("unknown key " + k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	uri.inherit()
+	return nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// blocks are encrypted with encryption-key before they leave the client,
+// names of files are not. Nonce is a MAC of the data, so same data is the
+// same encrypted block and dedup works among files of one key.
+//
+//	block = nonce | AES-256-GCM(data)
+const cryptOverhead = 12 + 16
+
+var ErrDecrypt = errors.New("block can not be decrypted, wrong encryption key")
+
+type blockCipher struct {
+	aead  cipher.AEAD
+	nonce []byte // key of MAC of nonce
+}
+
+// readEncryptionKey reads key file, a base64 key of 32 bytes.
+// Keys of encryption and nonce are derived from it.
+func readEncryptionKey(path string) (*blockCipher, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(bs)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New(path + ": invalid encryption key")
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("bfst encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &blockCipher{aead: aead, nonce: derive("bfst nonce")}, nil
+}
+
+func (c *blockCipher) encrypt(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.nonce)
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+	return c.aead.Seal(nonce, nonce, data, nil)
+}
+
+func (c *blockCipher) decrypt(bs []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(bs) < n {
+		return nil, ErrDecrypt
+	}
+	data, err := c.aead.Open(nil, bs[:n], bs[n:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return data, nil
+}
+
+// encryptBlock returns block as it is stored, it is a copy of data without encryption key
+func (uri *URI) encryptBlock(data []byte) []byte {
+	if uri.cipher == nil {
+		return append([]byte(nil), data...)
+	}
+	return uri.cipher.encrypt(data)
+}
+
+// decryptBlock returns data of stored block
+func (uri *URI) decryptBlock(bs []byte) ([]byte, error) {
+	if uri.cipher == nil {
+		return bs, nil
+	}
+	return uri.cipher.decrypt(bs)
+}
+
+// dataBlockSize is size of data in a block, encrypted block is not larger than BLOCKSIZE
+func (uri *URI) dataBlockSize() int {
+	if uri.cipher == nil {
+		return BLOCKSIZE
+	}
+	return BLOCKSIZE - cryptOverhead
+}
+
+// plainSize returns size of data in stored blocks of size n
+func (uri *URI) plainSize(n int64, blocks int) int64 {
+	if uri.cipher == nil {
+		return n
+	}
+	return n - int64(blocks)*cryptOverhead
+}
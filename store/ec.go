@@ -0,0 +1,247 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ecDescMax is size of largest stripe descriptor, head line and 255 blake3 shard ids
+const ecDescMax = 128 + 255*69
+
+// stripe is one block split into shards, shard i is stored in replica i.
+// Its descriptor is stored as a block in every replica, and .idx files
+// in replicas list descriptor hashes instead of block hashes.
+type stripe struct {
+	k, m   int
+	hash   string
+	size   int
+	shards []string
+
+	desc  string
+	dsize int
+}
+
+func (st *stripe) text() string {
+	return fmt.Sprintf("ec %d %d %s %d\n%s", st.k, st.m, st.hash, st.size, strings.Join(st.shards, "\n"))
+}
+
+// parseStripe parses descriptor, algo is hash of its id
+func parseStripe(algo string, bs []byte) (*stripe, error) {
+	lines := strings.Split(string(bs), "\n")
+	ts := strings.Split(lines[0], " ")
+	if len(ts) != 5 || ts[0] != "ec" {
+		return nil, errors.New("invalid stripe")
+	}
+	st := &stripe{hash: ts[3], shards: lines[1:]}
+	var err1, err2, err3 error
+	st.k, err1 = strconv.Atoi(ts[1])
+	st.m, err2 = strconv.Atoi(ts[2])
+	st.size, err3 = strconv.Atoi(ts[4])
+	if err1 != nil || err2 != nil || err3 != nil || len(st.shards) != st.k+st.m {
+		return nil, errors.New("invalid stripe")
+	}
+	st.desc = blockID(algo, bs)
+	st.dsize = len(bs)
+	return st, nil
+}
+
+// ecStripe reads stripe descriptor from cachedir or the first replica which has it.
+// Descriptors do not change, so they are kept in cachedir and index of ec store
+// needs no requests of descriptors after the first one.
+func (uri *URI) ecStripe(desc string) (*stripe, error) {
+	st, ok := uri.ecdesc[desc]
+	if ok {
+		return st, nil
+	}
+	path, fn := blockPath(desc)
+	bs, err := ioutil.ReadFile(uri.cacheDir() + "/" + path + "/" + fn)
+	if err != nil || checkBlock(desc, bs) != nil {
+		bs, err = uri.mirrorGetBlock(desc)
+		if err != nil {
+			return nil, err
+		}
+		uri.ecCache(desc, bs)
+	}
+	st, err = parseStripe(idAlgo(desc), bs)
+	if err != nil {
+		return nil, err
+	}
+	uri.ecadd(st)
+	return st, nil
+}
+
+// ecCache writes descriptor to cachedir
+func (uri *URI) ecCache(desc string, bs []byte) {
+	path, fn := blockPath(desc)
+	path = uri.cacheDir() + "/" + path
+	os.MkdirAll(path, 0755)
+	ioutil.WriteFile(path+"/"+fn, bs, 0644)
+}
+
+func (uri *URI) ecadd(st *stripe) {
+	if uri.ecdesc == nil {
+		uri.ecdesc = make(map[string]*stripe)
+		uri.ecblocks = make(map[string]*stripe)
+	}
+	uri.ecdesc[st.desc] = st
+	uri.ecblocks[st.hash] = st
+}
+
+// ecFiles returns files with block hashes instead of descriptor hashes
+func (uri *URI) ecFiles(flags []string) ([]*fileInfo, error) {
+	files, err := uri.mirrorFiles(flags)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		file.size = 0
+		for i, desc := range file.blocks {
+			st, err := uri.ecStripe(desc)
+			if err != nil {
+				return nil, errors.New(file.name + ": " + err.Error())
+			}
+			file.blocks[i] = st.hash
+			file.size += int64(st.size)
+		}
+	}
+	return files, nil
+}
+
+func (uri *URI) ecIndex() (map[string]int, error) {
+	files, err := uri.ecFiles(nil)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for _, file := range files {
+		for _, hash := range file.blocks {
+			index[hash] = uri.ecblocks[hash].size
+		}
+	}
+	return index, nil
+}
+
+// ecPutBlock stores block, shards and descriptor with ids of algo
+func (uri *URI) ecPutBlock(algo string, data []byte) error {
+	k := len(uri.replicas) - uri.parity
+	rs, err := newRS(k, uri.parity)
+	if err != nil {
+		return err
+	}
+
+	size := (len(data) + k - 1) / k
+	buf := make([]byte, size*len(uri.replicas))
+	copy(buf, data)
+	shards := make([][]byte, len(uri.replicas))
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size]
+	}
+	rs.encode(shards)
+
+	st := &stripe{k: k, m: uri.parity, hash: blockID(algo, data), size: len(data)}
+	cnt := 0
+	for i, r := range uri.replicas {
+		st.shards = append(st.shards, blockID(algo, shards[i]))
+		err = r.putBlockID(st.shards[i], shards[i])
+		if err != nil {
+			Warn(r.str() + " " + err.Error())
+			continue
+		}
+		cnt++
+	}
+	if cnt < uri.quorum {
+		return fmt.Errorf("quorum not reached %d/%d: %v", cnt, uri.quorum, err)
+	}
+
+	desc := []byte(st.text())
+	id := blockID(algo, desc)
+	err = uri.mirrorAll(func(r *URI) error { return r.putBlockID(id, desc) })
+	if err != nil {
+		return err
+	}
+	uri.ecCache(id, desc)
+	st, _ = parseStripe(algo, desc)
+	uri.ecadd(st)
+	return nil
+}
+
+// ecGetBlock reads shards and rebuilds block when some shards are missing or broken
+func (uri *URI) ecGetBlock(hash string) ([]byte, error) {
+	st, ok := uri.ecblocks[hash]
+	if !ok {
+		return nil, errors.New("unknown block " + hash)
+	}
+	if len(st.shards) > len(uri.replicas) {
+		return nil, errors.New("not enough replicas for block " + hash)
+	}
+	rs, err := newRS(st.k, st.m)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, len(st.shards))
+	cnt := 0
+	for i := 0; i < len(st.shards) && cnt < st.k; i++ {
+		r := uri.replicas[i]
+		bs, err := r.getBlock(st.shards[i])
+		if err == nil && checkBlock(st.shards[i], bs) != nil {
+			err = errors.New("checksum shard " + st.shards[i])
+		}
+		if err != nil {
+			Warn(r.str() + " " + err.Error())
+			continue
+		}
+		shards[i] = bs
+		cnt++
+	}
+	err = rs.reconstruct(shards)
+	if err != nil {
+		return nil, errors.New("block " + hash + ": " + err.Error())
+	}
+
+	var data []byte
+	for _, shard := range shards[:st.k] {
+		data = append(data, shard...)
+	}
+	if len(data) < st.size {
+		return nil, errors.New("block " + hash + ": short shards")
+	}
+	data = data[:st.size]
+	if checkBlock(hash, data) != nil {
+		return nil, errors.New("checksum block " + hash)
+	}
+	return data, nil
+}
+
+func (uri *URI) ecPutIndex(lines []string) error {
+	if len(lines) < 2 {
+		return errors.New("not enough input lines")
+	}
+	ts := strings.Split(lines[0], " ")
+	if len(ts) != 3 {
+		return errors.New("file head error")
+	}
+
+	// replicas keep descriptor hashes
+	result := []string{""}
+	size := 0
+	for _, hash := range lines[1:] {
+		if isManifestLine(hash) {
+			// root is of block ids, not of descriptors
+			result = append(result, hash)
+			continue
+		}
+		st, ok := uri.ecblocks[hash]
+		if !ok {
+			return errors.New("unknown block " + hash)
+		}
+		result = append(result, st.desc)
+		size += st.dsize
+	}
+	result[0] = fmt.Sprintf("%s %d %s", ts[0], size, ts[2])
+	return uri.mirrorAll(func(r *URI) error { return r.putIndex(result) })
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// frame is 0x26, 3 bytes length and data.
+// length 0xFFFFFF is followed by 8 bytes length for frames which need it,
+// they are sent only when bigframe is agreed by hello.
+const (
+	frameMagic = 0x26
+	frameExt   = 0xFFFFFF
+	smallFrame = frameExt - 1
+	bigFrame   = 1 << 30
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+var ErrFrameChecksum = errors.New("frame checksum error")
+
+// crc frame is used when crc is agreed by hello
+//
+//	magic(4) length(8) crc32 of magic and length(4) data crc32 of data(4)
+//
+// a frame with wrong header crc is not a frame, stream is searched for next magic.
+var crcMagic = []byte{frameMagic, 'B', 'F', 'S'}
+
+const crcHeader = 16
+
+func frameHeader(n int) []byte {
+	if n < frameExt {
+		return []byte{frameMagic, byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	hdr := []byte{frameMagic, 0xFF, 0xFF, 0xFF}
+	for i := 7; i >= 0; i-- {
+		hdr = append(hdr, byte(n>>(uint(i)*8)))
+	}
+	return hdr
+}
+
+// frameSize returns header size and data size of frame in buf, hsz is 0 when header is not complete
+func frameSize(buf []byte, limit int) (hsz, n int, err error) {
+	if len(buf) < 4 {
+		return 0, 0, nil
+	}
+	n = int(buf[1])<<16 + int(buf[2])<<8 + int(buf[3])
+	hsz = 4
+	if n == frameExt {
+		if len(buf) < 12 {
+			return 0, 0, nil
+		}
+		var n64 uint64
+		for _, b := range buf[4:12] {
+			n64 = n64<<8 + uint64(b)
+		}
+		if n64 > uint64(limit) {
+			return 0, 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n64)
+		}
+		n, hsz = int(n64), 12
+	}
+	if n > limit {
+		return 0, 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	return hsz, n, nil
+}
+
+// readFrame reads one frame, frames over limit are an error
+func readFrame(r io.Reader, limit int) ([]byte, error) {
+	hdr := make([]byte, 12)
+	_, err := io.ReadFull(r, hdr[:4])
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != frameMagic {
+		return nil, errors.New("invalid frame")
+	}
+	hsz, n, err := frameSize(hdr[:4], limit)
+	if err == nil && hsz == 0 {
+		_, err = io.ReadFull(r, hdr[4:])
+		if err == nil {
+			_, n, err = frameSize(hdr, limit)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func crcFrame(data []byte) []byte {
+	buf := make([]byte, crcHeader+len(data)+4)
+	copy(buf, crcMagic)
+	binary.BigEndian.PutUint64(buf[4:], uint64(len(data)))
+	binary.BigEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(buf[:12]))
+	copy(buf[crcHeader:], data)
+	binary.BigEndian.PutUint32(buf[crcHeader+len(data):], crc32.ChecksumIEEE(data))
+	return buf
+}
+
+// nextCRCFrame returns data of first frame in buf and bytes used by it,
+// used is bytes of noise when data is nil, it is 0 when more data is needed.
+func nextCRCFrame(buf []byte, limit int) (data []byte, used int, err error) {
+	i := bytes.Index(buf, crcMagic)
+	if i < 0 {
+		// keep bytes which may be start of magic
+		if len(buf) < len(crcMagic) {
+			return nil, 0, nil
+		}
+		return nil, len(buf) - len(crcMagic) + 1, nil
+	}
+	if i > 0 {
+		return nil, i, nil
+	}
+	if len(buf) < crcHeader {
+		return nil, 0, nil
+	}
+	if crc32.ChecksumIEEE(buf[:12]) != binary.BigEndian.Uint32(buf[12:]) {
+		return nil, 1, nil
+	}
+	n := binary.BigEndian.Uint64(buf[4:])
+	if n > uint64(limit) {
+		return nil, crcHeader, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	end := crcHeader + int(n)
+	if len(buf) < end+4 {
+		return nil, 0, nil
+	}
+	if crc32.ChecksumIEEE(buf[crcHeader:end]) != binary.BigEndian.Uint32(buf[end:]) {
+		return nil, end + 4, ErrFrameChecksum
+	}
+	return buf[crcHeader:end], end + 4, nil
+}
+
+// frameReader reads frames of remote bfst
+type frameReader struct {
+	r   io.Reader
+	buf []byte
+	crc bool
+}
+
+func (fr *frameReader) next(limit int) ([]byte, error) {
+	if !fr.crc {
+		return readFrame(fr.r, limit)
+	}
+	for {
+		data, used, err := nextCRCFrame(fr.buf, limit)
+		fr.buf = fr.buf[used:]
+		if err != nil || data != nil {
+			return data, err
+		}
+		if used > 0 {
+			continue
+		}
+		chunk := make([]byte, 64<<10)
+		n, err := fr.r.Read(chunk)
+		if n == 0 && err != nil {
+			return nil, err
+		}
+		fr.buf = append(fr.buf, chunk[:n]...)
+	}
+}
+
+// maxFrame returns size of largest frame which remote bfst accepts
+func (uri *URI) maxFrame() int {
+	if !uri.has("bigframe") {
+		return smallFrame
+	}
+	n, err := strconv.Atoi(uri.features["maxframe"])
+	if err != nil || n < smallFrame {
+		return smallFrame
+	}
+	return n
+}
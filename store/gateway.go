@@ -0,0 +1,141 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gatewayTTL is time a file of gateway is used before it is looked up again,
+// gatewayFiles is count of cached files
+const (
+	gatewayTTL   = 10 * time.Second
+	gatewayFiles = 100
+)
+
+// gateway serves stored files over http, uri is not safe for concurrent use
+type gateway struct {
+	uri   *URI
+	mu    sync.Mutex
+	files map[string]*gatewayFile
+}
+
+// gatewayFile is reader of a file, it is kept while content root is the same
+type gatewayFile struct {
+	r       *fileReader
+	etag    string
+	checked time.Time
+}
+
+type lockedReader struct {
+	r  io.ReaderAt
+	mu *sync.Mutex
+}
+
+func (l *lockedReader) ReadAt(p []byte, off int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.ReadAt(p, off)
+}
+
+// open returns cached file name, sizes of its blocks are only read when it changed.
+// g.mu is locked by caller.
+func (g *gateway) open(name string) (*gatewayFile, error) {
+	f := g.files[name]
+	if f != nil && time.Since(f.checked) < gatewayTTL {
+		return f, nil
+	}
+	fi, err := g.uri.stat(name)
+	if err != nil {
+		delete(g.files, name)
+		return nil, err
+	}
+	etag := "\"" + fileHash(fi) + "\""
+	if f != nil && f.etag == etag && f.r.fi.mtime.Equal(fi.mtime) {
+		f.checked = time.Now()
+		return f, nil
+	}
+	index, err := g.uri.hasBlocks(fi.blocks)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.uri.newFileReader(fi, index)
+	if err != nil {
+		return nil, err
+	}
+	if g.files == nil {
+		g.files = make(map[string]*gatewayFile)
+	}
+	for k := range g.files {
+		if len(g.files) < gatewayFiles {
+			break
+		}
+		delete(g.files, k)
+	}
+	f = &gatewayFile{r: r, etag: etag, checked: time.Now()}
+	g.files[name] = f
+	return f, nil
+}
+
+func (g *gateway) list(w http.ResponseWriter) {
+	g.mu.Lock()
+	ret, err := g.uri.getIndex(nil)
+	g.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body><pre>\n", html.EscapeString(g.uri.str()))
+	for _, file := range getFiles(strings.Split(string(ret), "\n")) {
+		fmt.Fprintf(w, "%-20s %-12d <a href=\"%s\">%s</a>\n",
+			strings.ReplaceAll(file.mtime.Format(time.RFC3339)[:19], "T", " "), g.uri.plainSize(file.size, len(file.blocks)),
+			url.PathEscape(file.name), html.EscapeString(file.name))
+	}
+	fmt.Fprintf(w, "</pre></body></html>\n")
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if name == "" {
+		g.list(w)
+		return
+	}
+
+	g.mu.Lock()
+	f, err := g.open(name)
+	g.mu.Unlock()
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	http.ServeContent(w, req, name, f.r.fi.mtime, io.NewSectionReader(&lockedReader{f.r, &g.mu}, 0, f.r.Size()))
+}
+
+// cmdServeFiles serves stored files read-only over http
+func (uri *URI) cmdServeFiles(args []string) error {
+	listen := ":8080"
+	if len(args) == 2 && args[0] == "--listen" {
+		listen = args[1]
+	} else if len(args) != 0 {
+		return errors.New("serve-files [--listen addr]")
+	}
+	println("serve", uri.str(), "on", listen)
+	return http.ListenAndServe(listen, &gateway{uri: uri})
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// protocol versions known by this bfst, newest is last
+var protoVersions = []string{"1.0", "1.1"}
+
+// Version of bfst, remote bfst is upgraded only to a newer version.
+// It is set by go build -ldflags "-X ham2.me/bfst/store.Version=1.2.0"
+var Version = "1.1.0"
+
+// protoFeatures are features of this bfst, value is a parameter like max frame size.
+// features which are not known by both sides are not used.
+var protoFeatures = map[string]string{
+	"hasBlocks":  "",
+	"index":      "",
+	"bigframe":   "",
+	"crc":        "",
+	"manifest":   "",
+	"putBlockID": "",
+	"maxframe":   strconv.Itoa(acceptedFrame()),
+}
+
+// acceptedFrame is size of largest frame bfst reads, requests over maxRequest are rejected
+func acceptedFrame() int {
+	if maxRequest < bigFrame {
+		return maxRequest
+	}
+	return bigFrame
+}
+
+// helloMessage is payload of hello command and of its reply
+//
+//	versions 1.0 1.1
+//	features hasBlocks maxframe=16777215
+func helloMessage(versions []string, features map[string]string) []byte {
+	ret := "versions " + strings.Join(versions, " ") + "\nfeatures"
+	for k, v := range features {
+		ret += " " + k
+		if v != "" {
+			ret += "=" + v
+		}
+	}
+	return []byte(ret)
+}
+
+func parseHello(data []byte) ([]string, map[string]string) {
+	var versions []string
+	features := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		ts := strings.Fields(line)
+		if len(ts) == 0 {
+			continue
+		}
+		switch ts[0] {
+		case "versions":
+			versions = ts[1:]
+		case "features":
+			for _, f := range ts[1:] {
+				n := strings.Index(f, "=")
+				if n < 0 {
+					features[f] = ""
+				} else {
+					features[f[:n]] = f[n+1:]
+				}
+			}
+		}
+	}
+	return versions, features
+}
+
+// helloValue returns value of key line in hello message
+func helloValue(data []byte, key string) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, key+" ") {
+			return line[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// negotiate returns highest common version and common features of peer and this bfst
+func negotiate(versions []string, features map[string]string) (string, map[string]string) {
+	version := ""
+	for _, v := range versions {
+		for _, lv := range protoVersions {
+			if v == lv && (version == "" || versionLess(version, v)) {
+				version = v
+			}
+		}
+	}
+	common := make(map[string]string)
+	for k, v := range features {
+		lv, ok := protoFeatures[k]
+		if !ok {
+			continue
+		}
+		if k == "maxframe" {
+			// both sides must accept the frame
+			n, err1 := strconv.Atoi(v)
+			ln, err2 := strconv.Atoi(lv)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			if n > ln {
+				n = ln
+			}
+			v = strconv.Itoa(n)
+		}
+		common[k] = v
+	}
+	return version, common
+}
+
+func versionLess(a, b string) bool {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// hello negotiates version and features after BFST_HELLO,
+// bfst 1.0 has no hello command and gets version 1.0 without features.
+func (uri *URI) hello() error {
+	ret, err := uri.call("hello", helloMessage(protoVersions, protoFeatures))
+	if _, ok := err.(*RemoteError); ok {
+		uri.version, uri.features = "1.0", map[string]string{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	uri.exe = helloValue(ret, "exe")
+	uri.exeVersion = helloValue(ret, "version")
+	uri.algo = helloValue(ret, "hash")
+	if uri.algo != "" {
+		err = validAlgo(uri.algo)
+		if err != nil {
+			return err
+		}
+	}
+	versions, features := parseHello(ret)
+	if len(versions) != 1 {
+		return errors.New("invalid hello reply")
+	}
+	uri.version, uri.features = negotiate(versions, features)
+	if uri.version == "" {
+		return errors.New("no common protocol version " + strings.Join(versions, " "))
+	}
+	if uri.has("crc") {
+		atomic.StoreInt32(uri.crc, 1)
+	}
+	return nil
+}
+
+// call runs command while connection is opened, it is not retried
+func (uri *URI) call(cmd string, data []byte) ([]byte, error) {
+	req := append([]byte{byte(len(cmd))}, cmd...)
+	uri.stdin <- append(req, data...)
+
+	select {
+	case ret := <-uri.stdout:
+		if ret == nil {
+			return nil, errors.New(cmd + " failed")
+		}
+		if len(ret) > 3 && string(ret[:3]) == "E: " {
+			return nil, &RemoteError{string(ret[3:])}
+		}
+		return ret, nil
+	case err := <-uri.echan:
+		return nil, err
+	case <-time.After(uri.retryPolicy().hello):
+		return nil, errors.New(cmd + " timed out")
+	}
+}
+
+// has returns true when feature is agreed with remote bfst
+func (uri *URI) has(feature string) bool {
+	_, ok := uri.features[feature]
+	return ok
+}
+
+// remoteHello is hello command of remote bfst
+func remoteHello(data []byte) ([]byte, map[string]string, error) {
+	version, features := negotiate(parseHello(data))
+	if version == "" {
+		return nil, nil, errors.New("no common protocol version")
+	}
+	ret := helloMessage([]string{version}, features)
+	if exe := exeInfo(); exe != "" {
+		ret = append(ret, "\nexe "+exe...)
+	}
+	ret = append(ret, "\nversion "+Version...)
+	return ret, features, nil
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rateEntry struct {
+	from, to int // minute of day, to is excluded
+	rate     int64
+}
+
+// rateLimiter limits average transfer rate, rate may change with time of day
+type rateLimiter struct {
+	entries []rateEntry
+	rate    int64 // rate out of all entries
+	mu      sync.Mutex
+	next    time.Time
+}
+
+// parseSize parses 10, 10K, 10M, 10G, units are 1024 based
+func parseSize(str string) (int64, error) {
+	mul := int64(1)
+	if len(str) > 0 {
+		switch str[len(str)-1] {
+		case 'k', 'K':
+			mul = 1 << 10
+		case 'm', 'M':
+			mul = 1 << 20
+		case 'g', 'G':
+			mul = 1 << 30
+		}
+	}
+	if mul > 1 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size " + str)
+	}
+	return int64(n * float64(mul)), nil
+}
+
+func parseClock(str string) (int, error) {
+	ts := strings.Split(str, ":")
+	if len(ts) != 2 {
+		return 0, errors.New("invalid time " + str)
+	}
+	h, err1 := strconv.Atoi(ts[0])
+	m, err2 := strconv.Atoi(ts[1])
+	if err1 != nil || err2 != nil || h < 0 || h > 24 || m < 0 || m > 59 {
+		return 0, errors.New("invalid time " + str)
+	}
+	return h*60 + m, nil
+}
+
+// parseRate parses rate or schedule of rates, 0 is unlimited
+//
+//	10M
+//	08:00-18:00=10M,0
+func parseRate(str string) (*rateLimiter, error) {
+	l := &rateLimiter{}
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		n := strings.Index(item, "=")
+		if n < 0 {
+			rate, err := parseSize(item)
+			if err != nil {
+				return nil, err
+			}
+			l.rate = rate
+			continue
+		}
+
+		ts := strings.Split(item[:n], "-")
+		if len(ts) != 2 {
+			return nil, errors.New("invalid time range " + item[:n])
+		}
+		from, err := parseClock(ts[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(ts[1])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := parseSize(item[n+1:])
+		if err != nil {
+			return nil, err
+		}
+		l.entries = append(l.entries, rateEntry{from, to, rate})
+	}
+	return l, nil
+}
+
+// current returns rate at time tm, first matched entry is used
+func (l *rateLimiter) current(tm time.Time) int64 {
+	m := tm.Hour()*60 + tm.Minute()
+	for _, e := range l.entries {
+		if e.from <= e.to && m >= e.from && m < e.to {
+			return e.rate
+		}
+		// range over midnight
+		if e.from > e.to && (m >= e.from || m < e.to) {
+			return e.rate
+		}
+	}
+	return l.rate
+}
+
+// wait is called after n bytes are transferred, it sleeps to keep rate
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	// workers of concurrency share limiter
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.current(now)
+	if rate <= 0 {
+		l.next = now
+		l.mu.Unlock()
+		return
+	}
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	next := l.next
+	l.mu.Unlock()
+	time.Sleep(next.Sub(now))
+}
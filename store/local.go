@@ -0,0 +1,782 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const LOCKFILE = "index.l"
+const BLOCKSIZE = 1024 * 1024
+
+type fileInfo struct {
+	name   string
+	mtime  time.Time
+	size   int64
+	blocks []string
+	root   string
+	sigs   []string
+}
+
+func (fi *fileInfo) read(index map[string]int, indexFile string) {
+	dat, err := ioutil.ReadFile(indexFile)
+	if err != nil || len(dat) == 0 {
+		return
+	}
+
+	for _, line := range strings.Split(string(dat), "\n") {
+		switch {
+		case strings.HasPrefix(line, rootPrefix):
+			fi.root = line[len(rootPrefix):]
+		case strings.HasPrefix(line, sigPrefix):
+			fi.sigs = append(fi.sigs, line)
+		default:
+			fi.blocks = append(fi.blocks, line)
+		}
+	}
+
+	var size int64
+	for _, hash := range fi.blocks {
+		sz, ok := index[hash]
+		if ok {
+			size += int64(sz)
+		}
+	}
+	fi.size = size
+}
+
+func (fi *fileInfo) index() string {
+	ret := fmt.Sprintf("%s %d %d\n", fi.name, fi.size, fi.mtime.Unix())
+	for _, block := range fi.blocks {
+		ret += fmt.Sprintf("%s\n", block)
+	}
+	if fi.root != "" {
+		ret += rootPrefix + fi.root + "\n"
+	}
+	for _, sig := range fi.sigs {
+		ret += sig + "\n"
+	}
+	return ret
+}
+
+// line returns fileInfo in ls format
+func (fi *fileInfo) line() string {
+	return fmt.Sprintf("%-20s %-12d %s\n", strings.ReplaceAll(fi.mtime.Format(time.RFC3339)[:19], "T", " "), fi.size, fi.name)
+}
+
+// cacheDir returns directory of downloaded blocks, it is the store for file store
+func (uri *URI) cacheDir() string {
+	if uri.proto == "file" {
+		return uri.path
+	}
+	cachedir := uri.cachedir
+	if cachedir == "" {
+		cachedir = os.Getenv("CACHEDIR")
+	}
+	if cachedir == "" {
+		cachedir = os.Getenv("HOME") + "/.bfst_cache"
+	}
+	return cachedir
+}
+
+// readBlock reads block from cache first, downloaded block is saved in cache
+func (uri *URI) readBlock(hash string) ([]byte, error) {
+	data, _, err := uri.loadBlock(hash)
+	return data, err
+}
+
+// loadBlock is readBlock which returns bytes downloaded, 0 when block is in cachedir
+func (uri *URI) loadBlock(hash string) ([]byte, int, error) {
+	cachedir := uri.cacheDir()
+	path, fn := blockPath(hash)
+	fpath := path + "/" + fn
+	bs, err := ioutil.ReadFile(cachedir + "/" + fpath)
+	if err == nil {
+		n := 0
+		if uri.proto == "file" {
+			// cachedir is the store
+			n = len(bs)
+		}
+		data, err := uri.decryptBlock(bs)
+		return data, n, err
+	}
+	err = os.MkdirAll(cachedir+"/"+path, 0755)
+	if err != nil {
+		return nil, 0, errors.New("create cachedir " + path)
+	}
+	bs, err = uri.getBlock(hash)
+	if err != nil {
+		return nil, 0, errors.New("download block " + hash + " " + err.Error())
+	}
+	uri.limiter.wait(len(bs))
+
+	err = checkBlock(hash, bs)
+	if err != nil {
+		return nil, 0, err
+	}
+	ioutil.WriteFile(cachedir+"/"+fpath, bs, 0644)
+	data, err := uri.decryptBlock(bs)
+	return data, len(bs), err
+}
+
+// fetch reads blocks with workers of uri ahead of the block which is taken,
+// next returns blocks in order and bytes downloaded. stop ends the workers.
+func (uri *URI) fetch(blocks []string) (next func() ([]byte, int, error), stop func()) {
+	type result struct {
+		data []byte
+		n    int
+		err  error
+	}
+	workers := uri.workers()
+	results := make([]chan result, len(blocks))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	jobs := make(chan int, len(blocks))
+	var stopped int32
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *URI) {
+			defer wg.Done()
+			for i := range jobs {
+				if atomic.LoadInt32(&stopped) == 0 {
+					data, n, err := w.loadBlock(blocks[i])
+					results[i] <- result{data, n, err}
+				}
+			}
+		}(w)
+	}
+
+	sent, taken := 0, 0
+	next = func() ([]byte, int, error) {
+		for sent < len(blocks) && sent <= taken+len(workers) {
+			jobs <- sent
+			sent++
+		}
+		r := <-results[taken]
+		taken++
+		return r.data, r.n, r.err
+	}
+	stop = func() {
+		atomic.StoreInt32(&stopped, 1)
+		close(jobs)
+		wg.Wait()
+	}
+	return
+}
+
+// write writes file content to w, blocks in cachedir are Skipped and not in Bytes of progress
+func (fi *fileInfo) write(ctx context.Context, uri *URI, w io.Writer, progress func(*Progress)) error {
+	size := uri.plainSize(fi.size, len(fi.blocks))
+	p := &Progress{Name: fi.name, Size: size, Blocks: len(fi.blocks)}
+	next, stop := uri.fetch(fi.blocks)
+	defer stop()
+	var written int64
+	for range fi.blocks {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		data, n, err := next()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+		written += int64(len(data))
+		p.Done++
+		p.Bytes += int64(n)
+		if n == 0 {
+			p.Skipped++
+			p.Deduped += int64(len(data))
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+	if written != size {
+		return errors.New("size not equal")
+	}
+	return nil
+}
+
+// download writes file to current directory, it returns progress of the last block
+func (fi *fileInfo) download(uri *URI) (*Progress, error) {
+	f, err := os.Create(fi.name)
+	if err != nil {
+		return nil, errors.New("create " + fi.name)
+	}
+	defer f.Close()
+
+	last := &Progress{Name: fi.name}
+	err = fi.write(context.Background(), uri, f, func(p *Progress) {
+		last = p
+		uri.out.getProgress(p)
+	})
+	uri.out.progressEnd()
+	return last, err
+}
+
+func (uri *URI) localListFiles(filter []string) ([]*fileInfo, error) {
+	index, err := uri.allIndex()
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(uri.path)
+	//println("readdir", len(index), len(files), err)
+	if err != nil {
+		return nil, err
+	}
+
+	regs, err := filterRegexps(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*fileInfo
+	for _, file := range files {
+		name := file.Name()
+		if strings.LastIndex(name, ".idx") != len(name)-4 {
+			continue
+		}
+		name = name[:len(name)-4]
+		if !uri.inPrefix(name) {
+			continue
+		}
+		//fmt.Fprintf(os.Stderr, "n=%s\n", name)
+		if len(regs) > 0 {
+			b := false
+			for _, r := range regs {
+				if r.Match([]byte(name)) {
+					b = true
+					break
+				}
+			}
+			if !b {
+				continue
+			}
+		}
+		fi := &fileInfo{
+			name:  name,
+			mtime: file.ModTime(),
+		}
+		fi.read(index, uri.path+"/"+file.Name())
+		if fi.size > 0 {
+			result = append(result, fi)
+		}
+	}
+	return result, nil
+}
+
+// filterRegexps compiles filters, * and ? are wildcards and /re/ is a regexp
+func filterRegexps(filter []string) ([]*regexp.Regexp, error) {
+	var regs []*regexp.Regexp
+	for _, f := range filter {
+		if f == "" {
+			continue
+		}
+		r, err := filterRegexp(f)
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, r)
+	}
+	return regs, nil
+}
+
+// filterRegexp compiles one filter
+func filterRegexp(f string) (*regexp.Regexp, error) {
+	if f[0] != '/' {
+		f = strings.ReplaceAll(f, "$", "\\$")
+		f = strings.ReplaceAll(f, "^", "\\^")
+		f = strings.ReplaceAll(f, ".", "\\.")
+		f = strings.ReplaceAll(f, "*", ".*")
+		f = strings.ReplaceAll(f, "?", ".")
+		f = "^" + f + "$"
+	} else if len(f) < 2 || f[len(f)-1] != '/' {
+		return nil, errors.New("invalid filter " + f)
+	} else {
+		f = f[1 : len(f)-1]
+	}
+	return regexp.Compile(f)
+}
+
+func (uri *URI) localWriteIndex(index map[string]int) error {
+	f, err := os.Create(uri.path + "/index")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for k, v := range index {
+		fmt.Fprintf(f, "%s %d\n", k, v)
+	}
+	return nil
+}
+
+func (uri *URI) localLockIndex() error {
+	for i := 0; i < 300; i++ {
+		_, err := os.Stat(uri.path + "/" + LOCKFILE)
+		if !os.IsExist(err) {
+			f, err := os.Create(uri.path + "/" + LOCKFILE)
+			if err != nil {
+				f.Close()
+			}
+			break
+		}
+		if i == 299 {
+			return errors.New("lock timed out")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// localInit adds blocks in directory hdr to index, prefix is "" for sha256 blocks
+func (uri *URI) localInit(prefix, hdr string, index map[string]int) {
+	basepath := uri.path + "/" + hdr
+	if prefix != "" {
+		basepath = uri.path + "/" + prefix + "/" + hdr
+	}
+	dirs, err := ioutil.ReadDir(basepath)
+	if err != nil {
+		// no dir
+		return
+	}
+	for _, dir := range dirs {
+		dn := dir.Name()
+		if len(dn) != 2 || dn[0] == '.' {
+			continue
+		}
+		path := basepath + "/" + dn
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			fn := file.Name()
+			fpath := path + "/" + fn
+			if len(fn) != 60 {
+				os.Remove(fpath)
+				continue
+			}
+			bs, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				os.Remove(fpath)
+				continue
+			}
+			hash := prefix + hdr + dn + fn
+			if checkBlock(hash, bs) != nil {
+				os.Remove(fpath)
+				continue
+			}
+			index[hash] = len(bs)
+		}
+	}
+}
+
+func (uri *URI) localPutIndex(lines []string) error {
+	err := validIndex(lines)
+	if err != nil {
+		return err
+	}
+
+	// read index
+	index, err := uri.allIndex()
+	if err != nil {
+		return err
+	}
+
+	// cal size
+	blocks := indexBlocks(lines[1:])
+	var size int64
+	for _, hash := range blocks {
+		bsz, ok := index[hash]
+		if !ok {
+			return errors.New("unknown block " + hash)
+		}
+		size += int64(bsz)
+	}
+
+	// verify size
+	ts := strings.Split(lines[0], " ")
+	if len(ts) != 3 {
+		return errors.New("file head error")
+	}
+	osize, _ := strconv.ParseInt(ts[1], 10, 64)
+	if size != osize {
+		return errors.New("file has wrong size")
+	}
+	err = uri.checkQuotaFile(&fileInfo{name: ts[0], size: size, blocks: blocks}, index)
+	if err != nil {
+		return err
+	}
+	fpath := uri.path + "/" + ts[0] + ".idx"
+	err = ioutil.WriteFile(fpath, []byte(strings.Join(lines[1:], "\n")), 0644)
+	if err != nil {
+		return err
+	}
+	uri.filesChanged()
+	uri.audit("putIndex", []string{ts[0]}, size)
+	return nil
+}
+
+// putFile puts blocks read from r which are not in index, it returns lines of index file.
+// Blocks are sent by workers of uri, a block is done when it is handed to a worker.
+func (uri *URI) putFile(ctx context.Context, name string, size int64, mtime time.Time, r io.Reader, index map[string]int, progress func(*Progress)) ([]string, error) {
+	var mu sync.Mutex
+	var perr error // first error of workers
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return perr
+	}
+	blocks := make(chan []byte)
+	var wg sync.WaitGroup
+	for _, w := range uri.workers() {
+		wg.Add(1)
+		go func(w *URI) {
+			defer wg.Done()
+			for block := range blocks {
+				if failed() != nil {
+					continue
+				}
+				err := w.putBlock(block)
+				mu.Lock()
+				if perr == nil {
+					perr = err
+				}
+				mu.Unlock()
+			}
+		}(w)
+	}
+
+	algo := uri.hashAlgo()
+	bsize := int64(uri.dataBlockSize())
+	buf := make([]byte, bsize)
+	p := &Progress{Name: name, Size: size, Blocks: int((size + bsize - 1) / bsize)}
+	result := []string{""}
+	var sent []string
+	var total int64
+	err := func() error {
+		for {
+			err := ctx.Err()
+			if err == nil {
+				err = failed()
+			}
+			if err != nil {
+				return err
+			}
+			bsz, err := io.ReadFull(r, buf)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			block := uri.encryptBlock(buf[:bsz])
+			hash := blockID(algo, block)
+
+			osz, has := index[hash]
+			if !has {
+				uri.limiter.wait(len(block))
+				blocks <- block
+				index[hash] = len(block)
+				sent = append(sent, hash)
+				p.Bytes += int64(len(block))
+			} else if osz != len(block) {
+				return fmt.Errorf("block[%s] size %d!=%d", hash, len(block), osz)
+			} else {
+				p.Skipped++
+				p.Deduped += int64(len(block))
+			}
+			p.Done++
+			if progress != nil {
+				progress(p)
+			}
+			total += int64(len(block))
+			result = append(result, hash)
+		}
+	}()
+	close(blocks)
+	wg.Wait()
+	if err == nil {
+		err = perr
+	}
+	if err != nil {
+		// index is used for next file, sent blocks may be missing
+		for _, hash := range sent {
+			delete(index, hash)
+		}
+		return nil, err
+	}
+	result[0] = fmt.Sprintf("%s %d %d", name, total, mtime.Unix())
+	fi := &fileInfo{name: name, size: total, blocks: result[1:]}
+	err = uri.seal(fi)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, rootPrefix+fi.root)
+	return append(result, fi.sigs...), nil
+}
+
+func (uri *URI) cmdPut(files []string, saveLocalIndex bool) error {
+	index, err := uri.allIndex()
+	if err != nil {
+		return err
+	}
+
+	// put files
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		// remove path part from filename
+		i := strings.LastIndex(fn, "/")
+		if i >= 0 {
+			fn = fn[i+1:]
+		}
+		i = strings.LastIndex(fn, "\\")
+		if i >= 0 {
+			fn = fn[i+1:]
+		}
+
+		var last *Progress
+		result, err := uri.putFile(context.Background(), fn, st.Size(), st.ModTime(), f, index, func(p *Progress) {
+			last = p
+			uri.out.putProgress(p)
+		})
+		f.Close()
+		uri.out.progressEnd()
+		if err != nil {
+			uri.out.printError(fn, err)
+			continue
+		}
+		if saveLocalIndex {
+			err = ioutil.WriteFile(fn+".idx", []byte(strings.Join(result, "\n")), 0644)
+		} else {
+			err = uri.putIndex(result)
+		}
+		if err != nil {
+			return err
+		}
+		uri.out.printFile(getFiles(result)[0], last)
+	}
+	return nil
+}
+
+func getFiles(lines []string) (files []*fileInfo) {
+	var file *fileInfo
+	for _, line := range lines {
+		ts := strings.Split(line, " ")
+		if len(ts) == 3 {
+			// name size mtime
+			if file != nil {
+				files = append(files, file)
+			}
+			file = &fileInfo{name: ts[0]}
+			file.size, _ = strconv.ParseInt(ts[1], 10, 64)
+			tm, _ := strconv.ParseInt(ts[2], 10, 64)
+			file.mtime = time.Unix(tm, 0)
+		}
+		if len(ts) == 1 && idAlgo(ts[0]) != "" && file != nil {
+			// blockhash
+			file.blocks = append(file.blocks, ts[0])
+		}
+		if len(ts) == 1 && file != nil && strings.HasPrefix(line, rootPrefix) {
+			file.root = line[len(rootPrefix):]
+		}
+		if len(ts) == 1 && file != nil && strings.HasPrefix(line, sigPrefix) {
+			file.sigs = append(file.sigs, line)
+		}
+	}
+	if file != nil {
+		files = append(files, file)
+	}
+	return
+}
+
+func (uri *URI) cmdGet(filter []string) error {
+	ret, err := uri.getIndex(filter)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range getFiles(strings.Split(string(ret), "\n")) {
+		var p *Progress
+		err = uri.verify(file)
+		if err == nil {
+			p, err = file.download(uri)
+		}
+		if err != nil {
+			uri.out.printError(file.name, err)
+			continue
+		}
+		uri.out.printFile(file, p)
+	}
+	return nil
+}
+
+// hashFile splits file into blocks the same way as cmdPut, sizes are of data of blocks
+func (uri *URI) hashFile(fn string) (blocks []string, sizes []int, err error) {
+	algo := uri.hashAlgo()
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, uri.dataBlockSize())
+	for {
+		bsz, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			return blocks, sizes, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		blocks = append(blocks, blockID(algo, uri.encryptBlock(buf[:bsz])))
+		sizes = append(sizes, bsz)
+	}
+}
+
+type blockRange struct {
+	First int   `json:"first"`
+	Last  int   `json:"last"`
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type diffResult struct {
+	Local          string       `json:"local"`
+	Size           int64        `json:"size"`
+	Blocks         int          `json:"blocks"`
+	Stored         string       `json:"stored"`
+	Found          bool         `json:"found"`
+	StoredSize     int64        `json:"stored_size"`
+	StoredBlocks   int          `json:"stored_blocks"`
+	Differ         []blockRange `json:"differ"`
+	Same           int          `json:"same"`
+	Transfer       int64        `json:"transfer"`
+	TransferBlocks int          `json:"transfer_blocks"`
+}
+
+// cmdDiff compares local file with stored file, nothing is uploaded
+func (uri *URI) cmdDiff(fn string, name string) error {
+	blocks, sizes, err := uri.hashFile(fn)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = fn[strings.LastIndexAny(fn, "/\\")+1:]
+	}
+
+	ret, err := uri.getIndex([]string{nameFilter(name)})
+	if err != nil {
+		return err
+	}
+	stored := &fileInfo{name: name}
+	files := getFiles(strings.Split(string(ret), "\n"))
+	if len(files) == 1 {
+		stored = files[0]
+	}
+	index, err := uri.allIndex()
+	if err != nil {
+		return err
+	}
+
+	res := &diffResult{Local: fn, Blocks: len(blocks), Stored: name, Found: len(files) == 1, StoredSize: uri.plainSize(stored.size, len(stored.blocks)), StoredBlocks: len(stored.blocks)}
+	for _, sz := range sizes {
+		res.Size += int64(sz)
+	}
+
+	// ranges of different blocks
+	var off int64
+	start := -1
+	var startOff int64
+	for i := 0; i <= len(blocks); i++ {
+		differ := i < len(blocks) && (i >= len(stored.blocks) || blocks[i] != stored.blocks[i])
+		if differ && start < 0 {
+			start = i
+			startOff = off
+		}
+		if !differ && start >= 0 {
+			res.Differ = append(res.Differ, blockRange{start, i - 1, startOff, off - 1})
+			start = -1
+		}
+		if i < len(blocks) {
+			if !differ {
+				res.Same++
+			}
+			off += int64(sizes[i])
+		}
+	}
+
+	// blocks which are not in store
+	for i, hash := range blocks {
+		if _, has := index[hash]; !has {
+			index[hash] = sizes[i]
+			res.Transfer += int64(sizes[i])
+			res.TransferBlocks++
+		}
+	}
+
+	if uri.out == jsonOutput {
+		printJSON(os.Stdout, res)
+		return nil
+	}
+	fmt.Printf("local  %-12d %-6d %s\n", res.Size, res.Blocks, fn)
+	if res.Found {
+		fmt.Printf("stored %-12d %-6d %s\n", res.StoredSize, res.StoredBlocks, name)
+	} else {
+		fmt.Printf("stored %s not found\n", name)
+	}
+	for _, d := range res.Differ {
+		fmt.Printf("differ blocks %d-%d bytes %d-%d\n", d.First, d.Last, d.Start, d.End)
+	}
+	if res.StoredBlocks > res.Blocks {
+		fmt.Printf("stored has %d more blocks\n", res.StoredBlocks-res.Blocks)
+	}
+	fmt.Printf("same %d/%d blocks\n", res.Same, res.Blocks)
+	fmt.Printf("put transfers %d bytes in %d blocks\n", res.Transfer, res.TransferBlocks)
+	return nil
+}
+
+func (uri *URI) cmdUpdate(idxfile string) error {
+	datafile := idxfile[:len(idxfile)-4]
+	bs, err := ioutil.ReadFile(idxfile)
+	if err != nil {
+		return uri.cmdPut([]string{datafile}, true)
+	}
+	files := getFiles(strings.Split(string(bs), "\n"))
+	if len(files) != 1 {
+		return errors.New("invalid idx file")
+	}
+	st, err := os.Stat(datafile)
+	if err != nil || files[0].mtime.Unix() > st.ModTime().Unix()+1 {
+		_, err = files[0].download(uri)
+		return err
+	}
+	if files[0].mtime.Unix() < st.ModTime().Unix()-1 {
+		return uri.cmdPut([]string{datafile}, true)
+	}
+	return nil
+}
@@ -0,0 +1,1189 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, cond bool, msg ...interface{}) {
+	if !cond {
+		debug.PrintStack()
+		t.Fatal(msg...)
+	}
+}
+
+func TestMain(t *testing.T) {
+	uri := parseURI("test")
+	assert(t, uri == nil, "parseURI nil")
+
+	uri = parseURI("file:test")
+	assert(t, uri != nil && uri.path == "test", "parseURI file")
+
+	const DIR = "/bfst_tmp"
+	path := os.Getenv("HOME") + DIR
+	os.RemoveAll(path)
+
+	uri = parseURI("file:" + path)
+	assert(t, uri != nil && uri.proto == "file", "parseURI file 2")
+	assert(t, uri.init() == nil, "init file Ok")
+
+	err := uri.putBlock(make([]byte, 4096))
+	assert(t, err == nil, "putBlock Ok")
+
+	uri = parseURI(os.Getenv("USER") + "@localhost" + DIR)
+	assert(t, uri != nil && uri.host == "localhost", "parseURI !nil")
+
+	err = uri.init()
+	assert(t, err == nil, "init path:", err)
+
+	index, err := uri.allIndex()
+	assert(t, err == nil && len(index) == 1, "allIndex == 1")
+
+	size := 65536 * 4
+	b := make([]byte, size)
+	for i := 0; i < 10; i++ {
+		b[0] = byte(i)
+		err = uri.putBlock(b)
+		assert(t, err == nil, "putBlock 2 Ok")
+	}
+	index, err = uri.allIndex()
+	assert(t, err == nil && len(index) == 11, "allIndex == 11")
+
+	for h, sz := range index {
+		b, err = uri.getBlock(h)
+		assert(t, err == nil && len(b) == sz, "getBlock")
+	}
+
+}
+
+func TestReedSolomon(t *testing.T) {
+	rs, err := newRS(4, 2)
+	assert(t, err == nil, "newRS")
+
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, 1000)
+		if i < 4 {
+			for j := range shards[i] {
+				shards[i][j] = byte(i*7 + j*13)
+			}
+		}
+	}
+	rs.encode(shards)
+
+	data := make([][]byte, 4)
+	for i := range data {
+		data[i] = append([]byte{}, shards[i]...)
+	}
+	shards[0] = nil
+	shards[2] = nil
+	assert(t, rs.reconstruct(shards) == nil, "reconstruct 2 missing")
+	for i := range data {
+		assert(t, string(shards[i]) == string(data[i]), "shard", i)
+	}
+
+	shards[1] = nil
+	shards[3] = nil
+	shards[4] = nil
+	assert(t, rs.reconstruct(shards) != nil, "reconstruct 3 missing")
+}
+
+func TestClient(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(dir)
+	path := dir + "/store"
+
+	_, err := Open("test")
+	assert(t, errors.Is(err, ErrInvalidURI), "Open invalid")
+
+	c, err := Open("file:" + path)
+	assert(t, err == nil, "Open")
+	// library prints nothing
+	out := stdout(func() { assert(t, c.uri.init() == nil, "init") })
+	assert(t, out == "", "output of init", out)
+
+	ctx := context.Background()
+	data := make([]byte, BLOCKSIZE*2+100)
+	for i := range data {
+		data[i] = byte(i*7 + i/BLOCKSIZE)
+	}
+	var last Progress
+	c.Progress = func(p Progress) { last = p }
+	err = c.Put(ctx, "a.dat", bytes.NewReader(data))
+	assert(t, err == nil, "Put", err)
+	assert(t, last.Done == 3 && last.Bytes == int64(len(data)), "Put progress")
+
+	assert(t, errors.Is(c.Put(ctx, "../a", bytes.NewReader(data)), ErrInvalidName), "Put invalid name")
+
+	err = c.Put(ctx, "b.dat", bytes.NewReader(data[:BLOCKSIZE]))
+	assert(t, err == nil && last.Skipped == 1 && last.Bytes == 0, "Put dedup")
+
+	files, err := c.List(ctx, "*.dat")
+	assert(t, err == nil && len(files) == 2, "List")
+	_, err = c.List(ctx, "/a")
+	assert(t, err != nil && strings.Contains(err.Error(), "invalid filter"), "List invalid filter", err)
+
+	fi, err := c.Stat(ctx, "a.dat")
+	assert(t, err == nil && fi.Size == int64(len(data)) && len(fi.Blocks) == 3, "Stat")
+
+	buf := &bytes.Buffer{}
+	err = c.Get(ctx, "a.dat", buf)
+	assert(t, err == nil && bytes.Equal(buf.Bytes(), data), "Get")
+
+	r, size, err := c.Open(ctx, "a.dat")
+	assert(t, err == nil && size == int64(len(data)), "Open file", err)
+	part := make([]byte, 200)
+	n, err := r.ReadAt(part, BLOCKSIZE-100)
+	assert(t, n == 200 && err == nil && bytes.Equal(part, data[BLOCKSIZE-100:BLOCKSIZE+100]), "ReadAt", err)
+	cctx, cancel := context.WithCancel(ctx)
+	r, _, err = c.Open(cctx, "a.dat")
+	assert(t, err == nil, "Open file", err)
+	cancel()
+	_, err = r.ReadAt(part, 0)
+	assert(t, errors.Is(err, context.Canceled), "ReadAt canceled", err)
+
+	// concurrent reads of one reader
+	r, _, _ = c.Open(ctx, "a.dat")
+	reads := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(off int64) {
+			p := make([]byte, 1000)
+			n, err := r.ReadAt(p, off)
+			reads <- n == 1000 && err == nil && bytes.Equal(p, data[off:off+1000])
+		}(int64(i) * BLOCKSIZE / 4)
+	}
+	for i := 0; i < 8; i++ {
+		assert(t, <-reads, "concurrent ReadAt")
+	}
+
+	// request to remote bfst is aborted, not only the next block
+	remote := &URI{proto: "tls", stdin: make(chan []byte, 2), stdout: make(chan []byte), activity: make(chan struct{}), echan: make(chan error)}
+	cctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	remote.setContext(cctx)
+	tm := time.Now()
+	_, err = remote.runRemote("getBlock", []byte(fi.Blocks[0]))
+	assert(t, errors.Is(err, context.DeadlineExceeded) && time.Since(tm) < time.Second && remote.stdin == nil, "runRemote canceled", err)
+
+	assert(t, c.Remove(ctx, "a.dat") == nil, "Remove")
+	_, err = c.Stat(ctx, "a.dat")
+	assert(t, errors.Is(err, ErrNotFound), "Stat removed")
+	assert(t, errors.Is(c.Remove(ctx, "a.dat"), ErrNotFound), "Remove removed")
+}
+
+func TestConfig(t *testing.T) {
+	// ~ of config is a temporary HOME
+	home, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	path := home + "/bfst_config"
+	os.Setenv("BFST_CONFIG", path)
+	defer os.Unsetenv("BFST_CONFIG")
+
+	ioutil.WriteFile(home+"/bfst_key", []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))), 0600)
+	conf := "cachedir = ~/cache\n[prod]\nuri = user@host:22/data\nport = 2222\nidentity = /id\ncompression = no\nconcurrency = 4\nencryption-key = ~/bfst_key\n" +
+		"[bad]\nuri = user@host\nconcurrency = 0\n[badkey]\nuri = user@host\nencryption-key = ~/bfst_none\n" +
+		"[backup]\nuri = mirror:(tls://127.0.0.1:1,mirror:(tls://127.0.0.1:2,@prod))\nconcurrency = 3\nlimit-rate = 1M\nretries = 5\nencryption-key = ~/bfst_key\n"
+	assert(t, ioutil.WriteFile(path, []byte(conf), 0644) == nil, "write config")
+
+	uri := parseURI("@prod")
+	assert(t, uri != nil && uri.proto == "ssh" && uri.port == "2222" && uri.path == "data", "parseURI @prod")
+	assert(t, uri.cachedir == home+"/cache", "cachedir")
+	assert(t, uri.concurrency == 4 && uri.cipher != nil, "concurrency and encryption-key")
+	assert(t, strings.Join(uri.cmds("ls"), " ") == "-T -i /id -p 2222 user@host cd data; ls", "cmds")
+
+	assert(t, parseURI("@bad") == nil, "parseURI @bad")
+	assert(t, parseURI("@badkey") == nil, "parseURI @badkey")
+	assert(t, parseURI("@none") == nil, "parseURI @none")
+
+	// replicas get settings of mirror which they do not set
+	uri = parseURI("@backup")
+	assert(t, uri != nil && len(uri.replicas) == 2, "parseURI @backup")
+	nested := uri.replicas[1]
+	for _, r := range []*URI{uri.replicas[0], nested, nested.replicas[0]} {
+		assert(t, r.concurrency == 3 && r.limiter == uri.limiter && r.retry == uri.retry && r.cipher == uri.cipher, "settings of replica", r.str())
+	}
+	prod := nested.replicas[1]
+	assert(t, prod.concurrency == 4 && prod.cipher != uri.cipher && prod.limiter == uri.limiter, "own settings of replica")
+	ws := uri.workers()
+	assert(t, len(ws) == 3 && ws[2].replicas[0] == uri.replicas[0].pool[1] && ws[2].replicas[1].replicas[1] == prod.pool[1], "workers of mirror")
+	uri.closeAll()
+}
+
+func TestLimitRate(t *testing.T) {
+	l, err := parseRate("08:00-18:00=10M,22:00-06:00=1K,0")
+	assert(t, err == nil, "parseRate", err)
+	day := func(h, m int) time.Time { return time.Date(2020, 1, 1, h, m, 0, 0, time.Local) }
+	assert(t, l.current(day(9, 0)) == 10<<20, "rate 9:00")
+	assert(t, l.current(day(18, 0)) == 0, "rate 18:00")
+	assert(t, l.current(day(23, 0)) == 1024 && l.current(day(5, 59)) == 1024, "rate over midnight")
+
+	_, err = parseRate("8-18=10M")
+	assert(t, err != nil, "parseRate invalid")
+
+	l, _ = parseRate("1M")
+	start := time.Now()
+	l.wait(1 << 18)
+	l.wait(1 << 18)
+	assert(t, time.Since(start) >= 500*time.Millisecond, "wait")
+}
+
+func TestFrame(t *testing.T) {
+	for _, n := range []int{0, 5, smallFrame, frameExt, 20 << 20} {
+		data := make([]byte, n)
+		buf := append(frameHeader(n), data...)
+		ret, err := readFrame(bytes.NewReader(buf), bigFrame)
+		assert(t, err == nil && len(ret) == n, fmt.Sprintf("readFrame %d", n))
+
+		ch := make(chan []byte, 1)
+		p := &pipeIO{ch: ch}
+		p.Write(buf[:3])
+		p.Write(buf[3:])
+		assert(t, len(<-ch) == n, fmt.Sprintf("pipeIO %d", n))
+	}
+	_, err := readFrame(bytes.NewReader(frameHeader(bigFrame+1)), bigFrame)
+	assert(t, errors.Is(err, ErrFrameTooLarge), "frame too large")
+
+	// noise and corrupted frames
+	crc := int32(1)
+	ch := make(chan []byte, 4)
+	errc := make(chan error, 1)
+	p := &pipeIO{ch: ch, crc: &crc, errc: errc}
+	bad := crcFrame([]byte("bad"))
+	bad[crcHeader] ^= 1
+	p.Write([]byte("motd &BF\x26"))
+	p.Write(append(append(bad, crcFrame([]byte("one"))...), 0x26, 'B'))
+	p.Write(append([]byte("FS"), crcFrame([]byte("two"))[4:]...))
+	assert(t, errors.Is(<-errc, ErrFrameChecksum), "crc error")
+	assert(t, string(<-ch) == "one", "crc frame one")
+	assert(t, string(<-ch) == "two", "crc frame two")
+}
+
+func TestValidate(t *testing.T) {
+	for _, name := range []string{"", ".idx", "../a", "a/b", "a\\b", "a\nb", "a b", "a..b"} {
+		assert(t, errors.Is(validName(name), ErrInvalidName), "validName "+name)
+	}
+	assert(t, validName("a-1.dat") == nil, "validName a-1.dat")
+	assert(t, validHash("00") != nil, "validHash short")
+	assert(t, validHash(strings.Repeat("0", 62)+"/x") != nil, "validHash path")
+	assert(t, validRequest("putIndex", []byte("../../x 1 0\n"+strings.Repeat("0", 64))) != nil, "putIndex traversal")
+	assert(t, validRequest("putBlock", make([]byte, BLOCKSIZE+1)) != nil, "putBlock too large")
+	for _, f := range []string{"/", "/a", "/(/"} {
+		assert(t, validRequest("ls", []byte("a\n"+f)) != nil, "invalid filter "+f)
+	}
+	assert(t, validRequest("ls", []byte("//\n/a.*/\n*.dat")) == nil, "valid filters")
+
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	ret := serve(uri, "", append(frameHeader(0), request("stats", nil)...))
+	assert(t, len(ret) == 2 && ret[0] == "E: invalid command", "empty frame", ret)
+	assert(t, !strings.HasPrefix(ret[1], "E:"), "request after empty frame", ret)
+	ret = serve(uri, "", append(request("ls", []byte("/")), request("rm", []byte("/"))...))
+	assert(t, len(ret) == 2 && strings.HasPrefix(ret[0], "E: invalid filter") && strings.HasPrefix(ret[1], "E: invalid filter"), "filter /", ret)
+	ret = serve(uri, "", append(frameHeader(maxRequest+1), request("stats", nil)...))
+	assert(t, len(ret) == 1 && strings.HasPrefix(ret[0], "E: frame too large"), "plain frame too large closes", ret)
+	assert(t, protoFeatures["maxframe"] == strconv.Itoa(maxRequest), "maxframe is limit of requests")
+}
+
+// testStore returns empty file store in a temp dir
+func testStore(t *testing.T) *URI {
+	dir, err := ioutil.TempDir("", "bfst")
+	assert(t, err == nil, err)
+	ioutil.WriteFile(dir+"/index", nil, 0644)
+	return parseURI("file:" + dir)
+}
+
+// request returns frame of remote command
+func request(cmd string, data []byte) []byte {
+	req := append(append([]byte{byte(len(cmd))}, cmd...), data...)
+	return append(frameHeader(len(req)), req...)
+}
+
+// serve runs frames of in with serveConn and returns replies after BFST_HELLO
+func serve(uri *URI, ident string, in []byte) []string {
+	var out bytes.Buffer
+	uri.serveConn(bytes.NewReader(in), &out, ident)
+	var ret []string
+	for {
+		data, err := readFrame(&out, bigFrame)
+		if err != nil {
+			break
+		}
+		ret = append(ret, string(data))
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret[1:]
+}
+
+func TestRange(t *testing.T) {
+	for _, c := range []struct {
+		rng    string
+		off, n int64
+	}{
+		{"10:20", 10, 20},
+		{"10:", 10, 90},
+		{"-30:", 70, 30},
+		{"-30:10", 70, 10},
+		{"-200:", 0, 100},
+		{"90:50", 90, 10},
+		{"150:", 100, 0},
+		{"150:10", 100, 0},
+		{"0:0", 0, 0},
+	} {
+		off, n, err := parseRange(c.rng, 100)
+		assert(t, err == nil && off == c.off && n == c.n, "parseRange "+c.rng, off, n, err)
+	}
+	for _, rng := range []string{"", "10", "a:1", "1:b", "1:-5", "1:2:3"} {
+		_, _, err := parseRange(rng, 100)
+		assert(t, err != nil, "invalid range "+rng)
+	}
+}
+
+func TestGoArch(t *testing.T) {
+	for _, c := range []struct{ uname, goos, goarch string }{
+		{"Linux x86_64\n", "linux", "amd64"},
+		{"Linux aarch64", "linux", "arm64"},
+		{"Darwin arm64", "darwin", "arm64"},
+		{"FreeBSD amd64", "freebsd", "amd64"},
+		{"Linux i686", "linux", "386"},
+		{"Linux armv7l", "linux", "arm"},
+		{"Linux riscv64", "linux", "riscv64"},
+	} {
+		goos, goarch, err := goArch(c.uname)
+		assert(t, err == nil && goos == c.goos && goarch == c.goarch, "goArch "+c.uname, goos, goarch, err)
+	}
+	for _, uname := range []string{"", "Linux", "Windows x86_64", "Linux sparc64", "Linux x86_64 extra"} {
+		_, _, err := goArch(uname)
+		assert(t, err != nil, "invalid uname "+uname)
+	}
+
+	// bfst of other os and arch is read from bindir, running bfst is used for its own
+	dir, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/bfst-linux-arm64", []byte("arm64"), 0755)
+	uri := &URI{bindir: dir}
+	bs, err := uri.bfstBinary("linux", "arm64")
+	assert(t, err == nil && string(bs) == "arm64", "binary of bindir", err)
+	_, err = uri.bfstBinary("netbsd", "mips64")
+	assert(t, err != nil && strings.Contains(err.Error(), "bfst-netbsd-mips64"), "missing binary", err)
+	exe, _ := os.Executable()
+	self, _ := ioutil.ReadFile(exe)
+	bs, err = uri.bfstBinary(runtime.GOOS, runtime.GOARCH)
+	assert(t, err == nil && bytes.Equal(bs, self), "running binary", err)
+}
+
+func TestDiff(t *testing.T) {
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	stored := make([]byte, BLOCKSIZE*4)
+	for i := range stored {
+		stored[i] = byte(i*7 + i/BLOCKSIZE)
+	}
+	index, _ := uri.allIndex()
+	lines, err := uri.putFile(context.Background(), "a.dat", int64(len(stored)), time.Now(), bytes.NewReader(stored), index, nil)
+	assert(t, err == nil && uri.putIndex(lines) == nil, "put", err)
+
+	// block 1 is new, block 3 is a copy of stored block 0 and block 4 is appended
+	local := append([]byte(nil), stored...)
+	local[BLOCKSIZE+5]++
+	copy(local[3*BLOCKSIZE:], stored[:BLOCKSIZE])
+	local = append(local, make([]byte, 50)...)
+	dir, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/a.dat", local, 0644)
+
+	uri.out = jsonOutput
+	out := stdout(func() { assert(t, uri.cmdDiff(dir+"/a.dat", "") == nil, "diff") })
+	var res diffResult
+	assert(t, json.Unmarshal([]byte(out), &res) == nil, "JSON of diff", out)
+	assert(t, res.Found && res.Stored == "a.dat" && res.StoredBlocks == 4 && res.Blocks == 5 && res.Size == int64(len(local)), "sizes of diff", res)
+	differ := []blockRange{{1, 1, BLOCKSIZE, 2*BLOCKSIZE - 1}, {3, 4, 3 * BLOCKSIZE, 4*BLOCKSIZE + 49}}
+	assert(t, reflect.DeepEqual(res.Differ, differ) && res.Same == 2, "blocks of diff", res.Differ)
+	assert(t, res.Transfer == BLOCKSIZE+50 && res.TransferBlocks == 2, "transfer of diff", res)
+
+	out = stdout(func() { assert(t, uri.cmdDiff(dir+"/a.dat", "b.dat") == nil, "diff of missing file") })
+	assert(t, json.Unmarshal([]byte(out), &res) == nil && !res.Found && res.Same == 0 && len(res.Differ) == 1, "diff of missing file", out)
+}
+
+func TestStats(t *testing.T) {
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	hash := make(map[string]string)
+	for name, size := range map[string]int{"x": 100, "y": 200, "z": 300, "u": 50} {
+		data := bytes.Repeat([]byte(name), size)
+		assert(t, uri.putBlock(data) == nil, "putBlock", name)
+		hash[name] = blockID(uri.hashAlgo(), data)
+	}
+	// x is shared by both files and u is unreferenced
+	assert(t, uri.putIndex([]string{"a 300 0", hash["x"], hash["y"]}) == nil, "put a")
+	assert(t, uri.putIndex([]string{"b 400 0", hash["x"], hash["z"]}) == nil, "put b")
+
+	ret, err := uri.stats([]string{"--json", "a"})
+	assert(t, err == nil, err)
+	var st storeStats
+	assert(t, json.Unmarshal(ret, &st) == nil, "JSON of stats", string(ret))
+	assert(t, st.Files == 2 && st.Logical == 700 && st.Physical == 650 && st.Blocks == 4, "usage", st)
+	assert(t, st.Referenced == 600 && st.Unreferenced == 50 && st.Ratio == 700.0/600, "references", st)
+	assert(t, st.Shared == 100 && st.SharedBlocks == 1, "shared", st)
+	sizes := []sizeCount{{64, 1}, {128, 1}, {256, 1}, {512, 1}}
+	assert(t, reflect.DeepEqual(st.Sizes, sizes), "block sizes", st.Sizes)
+	// rm of a unreferences only y
+	assert(t, reflect.DeepEqual(st.Selected, []fileStat{{"a", 300, 200}}) && st.Freed == 200, "selected", st.Selected, st.Freed)
+
+	ret, err = uri.stats(nil)
+	assert(t, err == nil && strings.Contains(string(ret), "physical     650 in 4 blocks\n") && strings.Contains(string(ret), "dedup ratio  1.17\n"), "text of stats", string(ret))
+}
+
+func TestBlockID(t *testing.T) {
+	empty := "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"
+	assert(t, blockID("blake3", nil) == "1e20"+empty, "blake3 empty")
+	assert(t, blockID("sha256", nil) == "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "sha256 empty")
+	data := make([]byte, 3072)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	assert(t, blockID("blake3", data) == "1e20b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2", "blake3 3072")
+
+	id := blockID("blake3", data)
+	assert(t, idAlgo(id) == "blake3" && validHash(id) == nil, "blake3 id")
+	assert(t, checkBlock(id, data) == nil, "checkBlock")
+	assert(t, errors.Is(checkBlock(id, data[1:]), ErrChecksum), "checkBlock changed")
+	assert(t, validHash("1f20"+empty) != nil, "unknown prefix")
+	dir, fn := blockPath(id)
+	assert(t, dir == "1e20/b9/8c" && fn == id[8:], "blockPath")
+}
+
+func TestManifest(t *testing.T) {
+	a, b, c := blockID("sha256", []byte("a")), blockID("sha256", []byte("b")), blockID("sha256", []byte("c"))
+	root := merkleRoot([]string{a, b, c})
+	assert(t, validHash(root) == nil, "root is block id")
+	assert(t, root != merkleRoot([]string{b, a, c}), "root of reordered blocks")
+	assert(t, root != merkleRoot([]string{a, b}), "root of removed block")
+
+	dir, err := ioutil.TempDir("", "bfst")
+	assert(t, err == nil, err)
+	defer os.RemoveAll(dir)
+	uri := &URI{signkey: dir + "/sign.key", trusted: dir + "/trusted_keys"}
+	seed := make([]byte, 32)
+	ioutil.WriteFile(uri.signkey, []byte(base64.StdEncoding.EncodeToString(seed)), 0600)
+	key, _ := uri.signKey()
+	pub := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	ioutil.WriteFile(uri.trusted, []byte("# comment\n"+pub+" test\n"), 0644)
+
+	fi := &fileInfo{name: "f", size: 3, blocks: []string{a, b, c}}
+	assert(t, uri.seal(fi) == nil && fi.root == root && len(fi.sigs) == 1, "seal")
+	assert(t, uri.verify(fi) == nil, "verify")
+	moved := *fi
+	moved.name = "g"
+	assert(t, errors.Is(uri.verify(&moved), ErrNotSigned), "verify other name")
+	moved = *fi
+	moved.blocks = []string{b, a, c}
+	assert(t, errors.Is(uri.verify(&moved), ErrManifest), "verify reordered")
+	moved = *fi
+	moved.sigs = nil
+	assert(t, errors.Is(uri.verify(&moved), ErrNotSigned), "verify unsigned")
+
+	// unsigned file is not restored
+	store := testStore(t)
+	defer os.RemoveAll(store.path)
+	store.trusted = uri.trusted
+	store.putBlock([]byte("a"))
+	store.putIndex([]string{"f 1 0", a})
+	_, err = store.openFile("f")
+	assert(t, errors.Is(err, ErrNotSigned), "openFile unsigned", err)
+	w := httptest.NewRecorder()
+	(&gateway{uri: store}).ServeHTTP(w, httptest.NewRequest("GET", "/f", nil))
+	assert(t, w.Code != http.StatusOK, "gateway unsigned", w.Code)
+}
+
+func TestSync(t *testing.T) {
+	src, dst := testStore(t), testStore(t)
+	defer os.RemoveAll(src.path)
+	defer os.RemoveAll(dst.path)
+	ioutil.WriteFile(dst.path+"/"+HASHFILE, []byte("blake3\n"), 0644)
+	src.signkey = src.path + "/sign.key"
+	ioutil.WriteFile(src.signkey, []byte(base64.StdEncoding.EncodeToString(make([]byte, 32))), 0600)
+
+	put := func(uri *URI, name string, data []byte) {
+		index, err := uri.allIndex()
+		assert(t, err == nil, err)
+		lines, err := uri.putFile(context.Background(), name, int64(len(data)), time.Now(), bytes.NewReader(data), index, nil)
+		assert(t, err == nil && uri.putIndex(lines) == nil, "put", name, err)
+	}
+	data := make([]byte, BLOCKSIZE*5/2)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+	put(src, "a", data)
+	put(dst, "b", data[:1000])
+
+	putIndexes := func(uri *URI) int {
+		bs, _ := ioutil.ReadFile(uri.path + "/" + AUDITFILE)
+		return strings.Count(string(bs), `"cmd":"putIndex"`)
+	}
+	assert(t, cmdSync(src, dst, nil, false) == nil, "sync sha256 to blake3")
+	fa, err := src.stat("a")
+	assert(t, err == nil, err)
+	fb, err := dst.stat("a")
+	assert(t, err == nil && strings.Join(fb.blocks, " ") == strings.Join(fa.blocks, " "), "ids are kept")
+	assert(t, fb.root == fa.root && len(fb.sigs) == 1 && fb.sigs[0] == fa.sigs[0], "signature is kept")
+	n := putIndexes(dst)
+	assert(t, cmdSync(src, dst, nil, false) == nil && putIndexes(dst) == n, "second sync changes nothing")
+
+	assert(t, cmdSync(dst, src, []string{"b"}, false) == nil, "sync blake3 to sha256")
+	fb, err = src.stat("b")
+	assert(t, err == nil && idAlgo(fb.blocks[0]) == "blake3", "blake3 id in sha256 store")
+	var buf bytes.Buffer
+	assert(t, fb.write(context.Background(), src, &buf, nil) == nil && bytes.Equal(buf.Bytes(), data[:1000]), "read blake3 block")
+
+	// 2.5M at 25M/s takes 100ms
+	dst2 := testStore(t)
+	defer os.RemoveAll(dst2.path)
+	src.limiter, _ = parseRate("25M")
+	dst2.limiter = src.limiter
+	start := time.Now()
+	assert(t, cmdSync(src, dst2, []string{"a"}, false) == nil, "sync with limit")
+	d := src.limiter.next.Sub(start)
+	assert(t, d >= 90*time.Millisecond && d < 150*time.Millisecond, "limit of sync", d)
+}
+
+func TestIdempotent(t *testing.T) {
+	// commands which only read are sent again when reply is lost
+	for cmd, perm := range cmdPerms {
+		assert(t, perm != "read" || idempotent[cmd], "idempotent "+cmd)
+	}
+	assert(t, !idempotent["rm"], "rm is not idempotent, reply of a lost rm differs")
+	for _, kv := range [][2]string{{"retries", "0"}, {"retry-backoff", "-1s"}, {"retry-max-backoff", "-1s"}, {"timeout", "0s"}, {"min-rate", "-1"}, {"hello-timeout", "-1s"}} {
+		rp := defaultRetry
+		assert(t, rp.configure(kv[0], kv[1]) != nil, "invalid "+kv[0])
+	}
+	rp := defaultRetry
+	assert(t, rp.configure("retries", "1") == nil && rp.configure("retry-backoff", "0s") == nil, "valid retry")
+	uri := testStore(t)
+	os.RemoveAll(uri.path)
+	_, err := uri.allIndex()
+	assert(t, errors.Is(err, ErrNoIndex), "allIndex without index", err)
+}
+
+func TestQuota(t *testing.T) {
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	ioutil.WriteFile(uri.path+"/"+QUOTAFILE, []byte("* 3000 -\nci- 1500 -\n"), 0644)
+	ioutil.WriteFile(uri.path+"/"+ACCESSFILE, []byte("user:ci put ci-\nuser:all put\n"), 0644)
+	block := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 1000) }
+
+	// blocks of a client count for quota of its prefix before they are in files
+	ret := serve(uri, "user:ci", append(request("putBlock", block(1)), request("putBlock", block(2))...))
+	assert(t, len(ret) == 2 && !strings.HasPrefix(ret[0], "E:"), "prefix quota", ret)
+	assert(t, strings.HasPrefix(ret[1], "E: "+ErrQuota.Error()+": ci- physical 2000 > 1500"), "prefix quota exceeded", ret)
+	var in []byte
+	for i := 1; i <= 4; i++ {
+		in = append(in, request("putBlock", block(i))...)
+	}
+	ret = serve(uri, "user:all", in)
+	assert(t, len(ret) == 4 && !strings.HasPrefix(ret[2], "E:"), "store quota", ret)
+	assert(t, strings.HasPrefix(ret[3], "E: "+ErrQuota.Error()+": * physical 4000 > 3000"), "store quota exceeded", ret)
+
+	// clients of a server pass quota one by one
+	uri = testStore(t)
+	defer os.RemoveAll(uri.path)
+	ioutil.WriteFile(uri.path+"/"+QUOTAFILE, []byte("* 5000 -\n"), 0644)
+	uri.shared = &sharedIndex{index: make(map[string]int)}
+	var wg sync.WaitGroup
+	var stored int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := *uri
+			if conn.putBlock(block(i)) == nil {
+				atomic.AddInt32(&stored, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert(t, stored == 5 && len(uri.shared.index) == 5, "concurrent quota", stored)
+}
+
+func TestHello(t *testing.T) {
+	ret, features, err := remoteHello(helloMessage([]string{"1.0", "1.1", "9.0"}, map[string]string{"crc": "", "unknown": ""}))
+	assert(t, err == nil, err)
+	versions, _ := parseHello(ret)
+	_, crc := features["crc"]
+	_, unknown := features["unknown"]
+	assert(t, len(versions) == 1 && versions[0] == "1.1" && crc && !unknown, "negotiate", string(ret))
+	assert(t, helloValue(ret, "version") == Version, "version of bfst", string(ret))
+	_, _, err = remoteHello(helloMessage([]string{"9.0"}, nil))
+	assert(t, err != nil, "no common version")
+
+	// remote bfst of same or newer version is kept
+	assert(t, versionLess("1.9", "1.10") && !versionLess(Version, Version), "versionLess")
+	for _, v := range []string{Version, "99.0"} {
+		uri := &URI{proto: "ssh", exe: "0 linux/amd64", exeVersion: v}
+		ok, err := uri.upgrade()
+		assert(t, !ok && err == nil, "no upgrade of", v, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	ioutil.WriteFile(uri.path+"/"+ACCESSFILE, []byte("user:r read\n"), 0644)
+	uri.metrics = newMetrics()
+	in := append(request("stats", nil), request("putBlock", []byte("x"))...)
+	in = append(in, request("x\"y\n", nil)...)
+	in = append(in, request("getBlock", []byte("../x"))...)
+	in = append(in, frameHeader(0)...)
+	ret := serve(uri, "user:r", in)
+	assert(t, len(ret) == 5, ret)
+
+	var out bytes.Buffer
+	uri.metrics.write(&out, nil)
+	for _, line := range []string{
+		`bfst_requests_total{cmd="stats",status="ok"} 1`,
+		`bfst_requests_total{cmd="putBlock",status="denied"} 1`,
+		`bfst_requests_total{cmd="getBlock",status="invalid"} 1`,
+		`bfst_requests_total{cmd="invalid",status="invalid"} 2`,
+	} {
+		assert(t, strings.Contains(out.String(), line+"\n"), line, out.String())
+	}
+	assert(t, !strings.Contains(out.String(), "x\\\""), "label of client", out.String())
+	assert(t, labelEscaper.Replace("a\\\"\n") == `a\\\"\n`, "escape label")
+
+	// stats are computed once until files change, new blocks are added to them
+	uri.shared = &sharedIndex{index: make(map[string]int)}
+	st := uri.metricsStats()
+	assert(t, st != nil && st.Files == 0 && st.Blocks == 0, "stats", st)
+	assert(t, uri.putBlock([]byte("block")) == nil, "putBlock")
+	st = uri.metricsStats()
+	assert(t, st.Blocks == 1 && st.Physical == 5 && st.Unreferenced == 5, "stats of new block", st)
+	assert(t, uri.localPutIndex([]string{"a 5 0", blockID(uri.hashAlgo(), []byte("block"))}) == nil, "putIndex")
+	st = uri.metricsStats()
+	assert(t, st.Files == 1 && st.Logical == 5 && st.Unreferenced == 0 && st.Ratio == 1, "stats of new file", st)
+	out.Reset()
+	uri.metrics.write(&out, st)
+	for _, line := range []string{
+		`bfst_cache_lookups_total{cache="stats",result="hit"} 1`,
+		`bfst_cache_lookups_total{cache="stats",result="miss"} 2`,
+		`bfst_dedup_lookups_total{result="new"} 1`,
+		`bfst_files 1`,
+	} {
+		assert(t, strings.Contains(out.String(), line+"\n"), line, out.String())
+	}
+}
+
+func TestAuth(t *testing.T) {
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	put := func(name string, data []byte) string {
+		id := blockID("sha256", data)
+		assert(t, uri.putBlock(data) == nil, "put block")
+		assert(t, uri.putIndex([]string{fmt.Sprintf("%s %d 0", name, len(data)), id}) == nil, "put index")
+		return id
+	}
+	a := put("ci-a", []byte("a"))
+	b := put("other", []byte("b"))
+	shard := blockID("sha256", []byte("shard"))
+	uri.putBlock([]byte("shard"))
+	put("ci-ec", []byte("ec 1 0 "+a+" 1\n"+shard))
+	ioutil.WriteFile(uri.path+"/"+ACCESSFILE, []byte("user:ci put ci-\nuser:all read\n"), 0644)
+
+	in := append(request("getBlock", []byte(a)), request("getBlock", []byte(b))...)
+	in = append(in, request("getBlock", []byte(shard))...)
+	in = append(in, request("hasBlocks", []byte(a+"\n"+b))...)
+	in = append(in, request("index", nil)...)
+	in = append(in, request("ls", nil)...)
+	in = append(in, request("putIndex", []byte("other 1 0\n"+b))...)
+	in = append(in, request("rm", []byte("ci-a"))...)
+	ret := serve(uri, "user:ci", in)
+	assert(t, len(ret) == 8, ret)
+	assert(t, ret[0] == "a" && ret[1] == "E: "+ErrPermission.Error() && ret[2] == "shard", "getBlock of prefix", ret)
+	assert(t, ret[3] == a+" 1\n", "hasBlocks of prefix", ret[3])
+	assert(t, !strings.Contains(ret[4], b) && strings.Contains(ret[4], a), "index of prefix", ret[4])
+	assert(t, strings.Contains(ret[5], "ci-a") && !strings.Contains(ret[5], "other"), "ls of prefix", ret[5])
+	assert(t, ret[6] == "E: "+ErrPermission.Error() && ret[7] == "E: "+ErrPermission.Error(), "put and rm denied", ret)
+
+	// visible blocks are cached until files change
+	c := blockID("sha256", []byte("c"))
+	in = append(request("getBlock", []byte(a)), request("putBlock", []byte("c"))...)
+	in = append(in, request("getBlock", []byte(c))...)
+	in = append(in, request("putIndex", []byte("ci-c 1 0\n"+c))...)
+	in = append(in, request("getBlock", []byte(c))...)
+	ret = serve(uri, "user:ci", in)
+	assert(t, len(ret) == 5 && ret[2] == "E: "+ErrPermission.Error() && ret[4] == "c", "block of new file", ret)
+	ci := *uri
+	ci.authorize("user:ci")
+	v1, _ := ci.visibleBlocks()
+	v2, _ := ci.visibleBlocks()
+	assert(t, v1[c] && reflect.ValueOf(v1).Pointer() == reflect.ValueOf(v2).Pointer(), "visible blocks cached")
+
+	ret = serve(uri, "user:all", append(request("getBlock", []byte(b)), request("putBlock", []byte("c"))...))
+	assert(t, len(ret) == 2 && ret[0] == "b" && ret[1] == "E: "+ErrPermission.Error(), "read grant", ret)
+	ret = serve(uri, "user:unknown", request("getBlock", []byte(b)))
+	assert(t, len(ret) == 1 && ret[0] == "E: "+ErrPermission.Error(), "unknown identity", ret)
+}
+
+func TestAudit(t *testing.T) {
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	ioutil.WriteFile(uri.path+"/"+ACCESSFILE, []byte("user:ci put ci-\nuser:adm admin\n"), 0644)
+	id := blockID("sha256", []byte("a"))
+
+	in := append(request("putBlock", []byte("a")), request("putIndex", []byte("ci-a 1 0\n"+id))...)
+	in = append(in, request("rm", []byte("ci-a"))...)
+	ret := serve(uri, "user:ci", in)
+	assert(t, len(ret) == 3 && ret[2] == "E: "+ErrPermission.Error(), "rm denied", ret)
+	ret = serve(uri, "user:adm", request("rm", []byte("ci-a")))
+	assert(t, len(ret) == 1 && !strings.HasPrefix(ret[0], "E:"), "rm", ret)
+
+	bs, err := uri.log([]string{"--json"})
+	assert(t, err == nil, err)
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	assert(t, len(lines) == 2, "records of changes", string(bs))
+	var put, rm auditRecord
+	json.Unmarshal([]byte(lines[0]), &put)
+	json.Unmarshal([]byte(lines[1]), &rm)
+	assert(t, put.User == "user:ci" && put.Cmd == "putIndex" && put.Size == 1 && put.Names[0] == "ci-a", "putIndex record", put)
+	assert(t, rm.User == "user:adm" && rm.Cmd == "rm" && rm.Names[0] == "ci-a", "rm record", rm)
+
+	bs, _ = uri.log([]string{"--user", "adm"})
+	assert(t, strings.Count(string(bs), "\n") == 1 && strings.Contains(string(bs), " rm "), "filter user", string(bs))
+	ret = serve(uri, "user:adm", request("log", []byte("--cmd\nputIndex")))
+	assert(t, len(ret) == 1 && strings.Contains(ret[0], "putIndex") && strings.Count(ret[0], "\n") == 1, "remote log", ret)
+	ret = serve(uri, "user:ci", request("log", nil))
+	assert(t, len(ret) == 1 && ret[0] == "E: "+ErrPermission.Error(), "log denied", ret)
+}
+
+func TestGateway(t *testing.T) {
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	put := func(data string) {
+		assert(t, uri.putBlock([]byte(data)) == nil, "put block")
+		assert(t, uri.putIndex([]string{fmt.Sprintf("a %d 0", len(data)), blockID("sha256", []byte(data))}) == nil, "put index")
+	}
+	put("first")
+	g := &gateway{uri: uri}
+	get := func(etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/a", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		g.ServeHTTP(w, req)
+		return w
+	}
+	w := get("")
+	etag := w.Header().Get("ETag")
+	assert(t, w.Body.String() == "first" && etag == "\""+merkleRoot([]string{blockID("sha256", []byte("first"))})+"\"", "get", etag)
+	assert(t, get(etag).Code == http.StatusNotModified, "etag")
+
+	// file is looked up again after ttl
+	put("second")
+	assert(t, get("").Body.String() == "first", "cached file")
+	g.files["a"].checked = time.Time{}
+	w = get(etag)
+	assert(t, w.Code == http.StatusOK && w.Body.String() == "second" && w.Header().Get("ETag") != etag, "changed file")
+}
+
+func TestECIndex(t *testing.T) {
+	var paths []string
+	for i := 0; i < 3; i++ {
+		r := testStore(t)
+		defer os.RemoveAll(r.path)
+		paths = append(paths, "file:"+r.path)
+	}
+	cache, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(cache)
+	str := "ec:(" + strings.Join(paths, ",") + ",parity=1)"
+	data := []byte("data of ec block")
+	hash := blockID("sha256", data)
+	uri := parseURI(str)
+	uri.cachedir = cache
+	assert(t, uri.putBlock(data) == nil, "ec put block")
+	assert(t, uri.putIndex([]string{fmt.Sprintf("a %d 0", len(data)), hash}) == nil, "ec put index")
+
+	// descriptors are read from cachedir, not from replicas
+	dir, fn := blockPath(uri.ecblocks[hash].desc)
+	for _, path := range paths {
+		os.Remove(path[5:] + "/" + dir + "/" + fn)
+	}
+	uri = parseURI(str)
+	uri.cachedir = cache + "/empty"
+	_, err := uri.allIndex()
+	assert(t, err != nil, "descriptor not in cachedir")
+	uri = parseURI(str)
+	uri.cachedir = cache
+	index, err := uri.allIndex()
+	assert(t, err == nil && index[hash] == len(data), "index from cachedir", err)
+}
+
+// stdout returns output of fn to stdout
+func stdout(fn func()) string {
+	r, w, _ := os.Pipe()
+	old := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		bs, _ := ioutil.ReadAll(r)
+		done <- bs
+	}()
+	fn()
+	w.Close()
+	os.Stdout = old
+	return string(<-done)
+}
+
+func TestJSON(t *testing.T) {
+	defer func(warn func(string)) { Warn = warn }(Warn)
+	uri := testStore(t)
+	defer os.RemoveAll(uri.path)
+	data := []byte("json data")
+	uri.putBlock(data)
+	uri.putIndex([]string{"a 9 0", blockID("sha256", data)})
+	ioutil.WriteFile(uri.path+"/"+QUOTAFILE, []byte("* 1000 -\n"), 0644)
+
+	dir, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	os.Setenv("BFST_CONFIG", dir+"/config")
+	defer os.Unsetenv("BFST_CONFIG")
+	ioutil.WriteFile(dir+"/config", []byte("cachedir = "+dir+"/cache\n[m]\nuri = mirror:(file:"+uri.path+")\n[f]\nuri = file:"+uri.path+"\n"), 0644)
+
+	lines := func(args ...string) []map[string]interface{} {
+		args = append([]string{"bfst", "--json"}, args...)
+		var ret []map[string]interface{}
+		out := stdout(func() {
+			assert(t, Main(args) == 0, "Main", args)
+		})
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			v := make(map[string]interface{})
+			assert(t, json.Unmarshal([]byte(line), &v) == nil, "JSON line", line)
+			ret = append(ret, v)
+		}
+		return ret
+	}
+	ret := lines("@m", "ls")
+	assert(t, len(ret) == 1 && ret[0]["name"] == "a" && ret[0]["size"] == 9.0 && ret[0]["blocks"] == 1.0, "ls", ret)
+	ret = lines("@m", "get", "a")
+	assert(t, len(ret) == 1 && ret[0]["bytes"] == 9.0 && ret[0]["deduped"] == 0.0, "get", ret)
+	ret = lines("@m", "get", "a")
+	assert(t, len(ret) == 1 && ret[0]["bytes"] == 0.0 && ret[0]["deduped"] == 9.0, "get from cachedir", ret)
+	ioutil.WriteFile(dir+"/p.dat", []byte("put data"), 0644)
+	ret = lines("@f", "put", "p.dat")
+	assert(t, len(ret) == 1 && ret[0]["name"] == "p.dat" && ret[0]["bytes"] == 8.0 && ret[0]["hash"] != "", "put", ret)
+	ret = lines("@f", "put", "p.dat")
+	assert(t, len(ret) == 1 && ret[0]["bytes"] == 0.0 && ret[0]["deduped"] == 8.0, "put of stored data", ret)
+	ret = lines("@f", "diff", "p.dat")
+	assert(t, len(ret) == 1 && ret[0]["found"] == true && ret[0]["same"] == 1.0 && ret[0]["transfer"] == 0.0, "diff", ret)
+	ret = lines("@f", "stats")
+	assert(t, len(ret) == 1 && ret[0]["files"] == 2.0 && ret[0]["logical"] == 17.0, "stats", ret)
+	ret = lines("@f", "quota")
+	assert(t, len(ret) == 1 && ret[0]["prefix"] == "*" && ret[0]["physical_quota"] == 1000.0, "quota", ret)
+	ret = lines("@m", "rm", "a")
+	assert(t, len(ret) == 1 && ret[0]["name"] == "a" && ret[0]["removed"] == true, "rm", ret)
+	ret = lines("@f", "init")
+	assert(t, len(ret) == 1 && ret[0]["store"] != "", "init", ret)
+}
+
+func TestMirror(t *testing.T) {
+	a, b := testStore(t), testStore(t)
+	defer os.RemoveAll(a.path)
+	defer os.RemoveAll(b.path)
+	warn := Warn
+	defer func() { Warn = warn }()
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+
+	// third replica can not be written, its parent is a file
+	list := a.path + "/replicas"
+	ioutil.WriteFile(list, []byte("# replicas\nfile:"+a.path+"\n\nfile:"+b.path+"\nfile:"+list+"/x\n"), 0644)
+	uri := parseURI("mirror:" + list)
+	assert(t, uri != nil && len(uri.replicas) == 3 && uri.quorum == 2, "replicas of list file")
+	assert(t, parseURI("mirror:"+a.path+"/none") == nil, "missing list file")
+	assert(t, parseURI("mirror:(file:a,quorum=2)") == nil, "quorum of more than replicas")
+
+	data := []byte("mirrored")
+	hash := blockID("sha256", data)
+	assert(t, uri.putBlock(data) == nil && len(warnings) > 0, "quorum of 2 replicas", warnings)
+	assert(t, uri.putIndex([]string{"m 8 0", hash}) == nil, "put index on quorum")
+	all := parseURI("mirror:(file:" + a.path + ",file:" + b.path + ",file:" + list + "/x,quorum=3)")
+	err := all.putBlock(data)
+	assert(t, err != nil && strings.Contains(err.Error(), "quorum not reached 2/3"), "quorum of 3 replicas", err)
+
+	// block is read from the next replica when it is missing or broken
+	dir, fn := blockPath(hash)
+	os.Remove(a.path + "/" + dir + "/" + fn)
+	bs, err := uri.getBlock(hash)
+	assert(t, err == nil && bytes.Equal(bs, data), "failover of missing block", err)
+	ioutil.WriteFile(a.path+"/"+dir+"/"+fn, []byte("broken"), 0644)
+	bs, err = uri.getBlock(hash)
+	assert(t, err == nil && bytes.Equal(bs, data), "failover of broken block", err)
+	os.Remove(b.path + "/" + dir + "/" + fn)
+	_, err = uri.getBlock(hash)
+	assert(t, err != nil, "no valid copy")
+
+	// newest file of replicas wins
+	b.putBlock([]byte("new"))
+	b.putIndex([]string{"m 3 0", blockID("sha256", []byte("new"))})
+	tm := time.Now().Add(time.Hour)
+	os.Chtimes(b.path+"/m.idx", tm, tm)
+	ret, err := uri.getIndex(nil)
+	assert(t, err == nil, err)
+	files := getFiles(strings.Split(string(ret), "\n"))
+	assert(t, len(files) == 1 && files[0].size == 3, "newest file", string(ret))
+}
+
+func TestEC(t *testing.T) {
+	var paths []string
+	for i := 0; i < 3; i++ {
+		r := testStore(t)
+		defer os.RemoveAll(r.path)
+		paths = append(paths, "file:"+r.path)
+	}
+	cache, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(cache)
+	str := "ec:(" + strings.Join(paths, ",") + ",parity=1)"
+	data := make([]byte, 1001)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	hash := blockID("sha256", data)
+	uri := parseURI(str)
+	uri.cachedir = cache
+	assert(t, uri.putBlock(data) == nil, "ec put block")
+	assert(t, uri.putIndex([]string{fmt.Sprintf("a %d 0", len(data)), hash}) == nil, "ec put index")
+	shards := uri.ecblocks[hash].shards
+	assert(t, len(shards) == 3, "shards", shards)
+
+	// shard i is in replica i
+	shardFile := func(i int) string {
+		dir, fn := blockPath(shards[i])
+		return paths[i][5:] + "/" + dir + "/" + fn
+	}
+	get := func() ([]byte, error) {
+		uri := parseURI(str)
+		uri.cachedir = cache
+		_, err := uri.allIndex()
+		assert(t, err == nil, "ec index", err)
+		return uri.getBlock(hash)
+	}
+	warn := Warn
+	defer func() { Warn = warn }()
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+
+	for i := range shards {
+		bs, _ := ioutil.ReadFile(shardFile(i))
+		os.Remove(shardFile(i))
+		ret, err := get()
+		assert(t, err == nil && bytes.Equal(ret, data), "missing shard", i, err)
+
+		broken := append([]byte(nil), bs...)
+		broken[0] ^= 1
+		ioutil.WriteFile(shardFile(i), broken, 0644)
+		warnings = nil
+		ret, err = get()
+		assert(t, err == nil && bytes.Equal(ret, data), "broken shard", i, err)
+		// parity shard is only read when a data shard fails
+		assert(t, i == 2 || len(warnings) == 1 && strings.Contains(warnings[0], "checksum shard"), "warning of broken shard", warnings)
+		ioutil.WriteFile(shardFile(i), bs, 0644)
+	}
+
+	os.Remove(shardFile(0))
+	os.Remove(shardFile(2))
+	_, err := get()
+	assert(t, err != nil && strings.Contains(err.Error(), "not enough shards"), "two shards missing", err)
+}
+
+// testCert returns self-signed certificate of 127.0.0.1 and its pem file
+func testCert(t *testing.T, dir string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert(t, err == nil, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bfst test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert(t, err == nil, err)
+	path := dir + "/ca.pem"
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func TestEncryption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(dir)
+	for i, key := range []string{"", "not base64", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		ioutil.WriteFile(dir+"/bad", []byte(key), 0600)
+		_, err := readEncryptionKey(dir + "/bad")
+		assert(t, err != nil, "invalid key", i)
+	}
+	_, err := readEncryptionKey(dir + "/none")
+	assert(t, os.IsNotExist(err), "missing key", err)
+
+	ioutil.WriteFile(dir+"/key1", []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n"), 0600)
+	ioutil.WriteFile(dir+"/key2", []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))), 0600)
+	c1, err := readEncryptionKey(dir + "/key1")
+	assert(t, err == nil, err)
+	c2, err := readEncryptionKey(dir + "/key2")
+	assert(t, err == nil, err)
+	uri := &URI{cipher: c1}
+	data := []byte("some data of a block")
+
+	// same data and key is the same block, so blocks are deduped
+	bs := uri.encryptBlock(data)
+	assert(t, len(bs) == len(data)+cryptOverhead && !bytes.Contains(bs, data), "encrypted block")
+	assert(t, bytes.Equal(bs, uri.encryptBlock(data)), "deterministic encryption")
+	assert(t, !bytes.Equal(bs, uri.encryptBlock([]byte("some data of a blocK"))), "nonce of other data")
+	assert(t, !bytes.Equal(bs, (&URI{cipher: c2}).encryptBlock(data)), "block of other key")
+	plain, err := uri.decryptBlock(bs)
+	assert(t, err == nil && bytes.Equal(plain, data), "decrypt", err)
+
+	_, err = (&URI{cipher: c2}).decryptBlock(bs)
+	assert(t, err == ErrDecrypt, "decrypt with other key", err)
+	bs[len(bs)-1] ^= 1
+	_, err = uri.decryptBlock(bs)
+	assert(t, err == ErrDecrypt, "tampered block", err)
+	_, err = uri.decryptBlock(bs[:5])
+	assert(t, err == ErrDecrypt, "short block", err)
+
+	// sizes count overhead of each block only with key
+	assert(t, uri.dataBlockSize() == BLOCKSIZE-cryptOverhead && uri.plainSize(1000, 3) == 1000-3*cryptOverhead, "sizes with key")
+	plainURI := &URI{}
+	assert(t, plainURI.dataBlockSize() == BLOCKSIZE && plainURI.plainSize(1000, 3) == 1000, "sizes without key")
+	bs = plainURI.encryptBlock(data)
+	bs[0] = 'S'
+	assert(t, data[0] == 's', "block without key is a copy")
+	plain, err = plainURI.decryptBlock(data)
+	assert(t, err == nil && bytes.Equal(plain, data), "decrypt without key")
+}
+
+func TestServe(t *testing.T) {
+	st := testStore(t)
+	defer os.RemoveAll(st.path)
+	err := cmdServe([]string{"--store", st.path, "--cert", "cert.pem", "--key", "key.pem"})
+	assert(t, err != nil && strings.Contains(err.Error(), "--insecure"), "serve without access file", err)
+	st.shared = &sharedIndex{index: make(map[string]int)}
+	dir, _ := ioutil.TempDir("", "bfst")
+	defer os.RemoveAll(dir)
+	cert, ca := testCert(t, dir)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert(t, err == nil, err)
+	s := &server{uri: st, ln: ln, conns: make(map[net.Conn]bool)}
+	go s.serve()
+	defer s.shutdown()
+
+	// blocks are encrypted and sent over 3 connections
+	c, err := Open("tls://" + ln.Addr().String())
+	assert(t, err == nil, err)
+	defer c.Close()
+	c.uri.ca, c.uri.cachedir, c.uri.concurrency = ca, dir+"/cache", 3
+	ioutil.WriteFile(dir+"/key", []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))), 0600)
+	c.uri.cipher, err = readEncryptionKey(dir + "/key")
+	assert(t, err == nil, err)
+	data := make([]byte, BLOCKSIZE*4+100)
+	for i := range data {
+		data[i] = byte(i*13 + i/BLOCKSIZE)
+	}
+	ctx := context.Background()
+	var last Progress
+	c.Progress = func(p Progress) { last = p }
+	err = c.Put(ctx, "a.dat", bytes.NewReader(data))
+	assert(t, err == nil, "Put", err)
+	s.mu.Lock()
+	conns := len(s.conns)
+	s.mu.Unlock()
+	assert(t, len(c.uri.pool) == 2 && conns == 3, "connections of concurrency", conns)
+	for id := range st.shared.copy() {
+		dir, fn := blockPath(id)
+		bs, _ := ioutil.ReadFile(st.path + "/" + dir + "/" + fn)
+		assert(t, len(bs) > 0 && !bytes.Contains(bs, data[:64]), "block is encrypted")
+	}
+	assert(t, c.Put(ctx, "b.dat", bytes.NewReader(data)) == nil && last.Skipped == 5, "dedup of encrypted blocks")
+
+	var buf bytes.Buffer
+	assert(t, c.Get(ctx, "a.dat", &buf) == nil && bytes.Equal(buf.Bytes(), data), "Get")
+	fi, err := c.Stat(ctx, "a.dat")
+	assert(t, err == nil && fi.Size == int64(len(data)), "Stat size of data", fi)
+	r, size, err := c.Open(ctx, "b.dat")
+	assert(t, err == nil, "Open", err)
+	part := make([]byte, 300)
+	_, err = r.ReadAt(part, 3*BLOCKSIZE-100)
+	assert(t, err == nil && size == int64(len(data)) && bytes.Equal(part, data[3*BLOCKSIZE-100:3*BLOCKSIZE+200]), "ReadAt", err)
+
+	// blocks can not be read with another key
+	os.RemoveAll(dir + "/cache")
+	ioutil.WriteFile(dir+"/key", []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))), 0600)
+	c.uri.cipher, _ = readEncryptionKey(dir + "/key")
+	assert(t, errors.Is(c.Get(ctx, "a.dat", &buf), ErrDecrypt), "Get with other key")
+
+	// mirror passes concurrency and key to its replicas
+	st2 := testStore(t)
+	defer os.RemoveAll(st2.path)
+	st2.shared = &sharedIndex{index: make(map[string]int)}
+	ln2, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert(t, err == nil, err)
+	s2 := &server{uri: st2, ln: ln2, conns: make(map[net.Conn]bool)}
+	go s2.serve()
+	defer s2.shutdown()
+	m, err := Open("mirror:(tls://" + ln.Addr().String() + ",tls://" + ln2.Addr().String() + ")")
+	assert(t, err == nil, err)
+	defer m.Close()
+	m.uri.cachedir = dir + "/mcache"
+	for _, r := range m.uri.replicas {
+		r.ca = ca
+	}
+	err = m.uri.configure(map[string]string{"concurrency": "2", "encryption-key": dir + "/key"})
+	assert(t, err == nil, err)
+	assert(t, m.Put(ctx, "m.dat", bytes.NewReader(data)) == nil, "Put to mirror")
+	s2.mu.Lock()
+	conns = len(s2.conns)
+	s2.mu.Unlock()
+	assert(t, conns == 2, "connections of replica", conns)
+	for id := range st2.shared.copy() {
+		dir, fn := blockPath(id)
+		bs, _ := ioutil.ReadFile(st2.path + "/" + dir + "/" + fn)
+		assert(t, len(bs) > 0 && !bytes.Contains(bs, data[:64]), "block of replica is encrypted")
+	}
+	buf.Reset()
+	assert(t, m.Get(ctx, "m.dat", &buf) == nil && bytes.Equal(buf.Bytes(), data), "Get from mirror")
+}
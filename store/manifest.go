@@ -0,0 +1,242 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifest lines follow block ids in .idx files and putIndex, bfst without
+// feature manifest ignores them
+//
+//	root:<merkle root of block ids>
+//	sig:<base64 public key>:<base64 ed25519 signature>
+const (
+	rootPrefix = "root:"
+	sigPrefix  = "sig:"
+)
+
+var (
+	ErrManifest  = errors.New("manifest does not match blocks")
+	ErrNotSigned = errors.New("no signature of a trusted key")
+)
+
+func isManifestLine(line string) bool {
+	return strings.HasPrefix(line, rootPrefix) || strings.HasPrefix(line, sigPrefix)
+}
+
+// indexBlocks returns block ids of index lines without manifest lines
+func indexBlocks(lines []string) []string {
+	var ret []string
+	for _, line := range lines {
+		if !isManifestLine(line) {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+// merkleRoot returns root of binary hash tree over block ids in order,
+// hash is the one of first block. Leaves are H(0 id), nodes H(1 left right)
+// and the last node of an odd level moves up unchanged.
+func merkleRoot(blocks []string) string {
+	algo := "sha256"
+	if len(blocks) > 0 && idAlgo(blocks[0]) != "" {
+		algo = idAlgo(blocks[0])
+	}
+	if len(blocks) == 0 {
+		return hashPrefixes[algo] + hex.EncodeToString(hashSum(algo, nil))
+	}
+	var level [][]byte
+	for _, id := range blocks {
+		level = append(level, hashSum(algo, append([]byte{0}, id...)))
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{1}, level[i]...)
+			next = append(next, hashSum(algo, append(node, level[i+1]...)))
+		}
+		level = next
+	}
+	return hashPrefixes[algo] + hex.EncodeToString(level[0])
+}
+
+// fileHash identifies content of file, it is root of its manifest
+func fileHash(fi *fileInfo) string {
+	if fi.root != "" {
+		return fi.root
+	}
+	return merkleRoot(fi.blocks)
+}
+
+// signedMessage is what a signature of a manifest covers,
+// so a manifest can not be moved to another name
+func signedMessage(name string, size int64, root string) []byte {
+	return []byte(fmt.Sprintf("bfst manifest\n%s %d %s", name, size, root))
+}
+
+func parseSig(line string) (ed25519.PublicKey, []byte, error) {
+	ts := strings.Split(strings.TrimPrefix(line, sigPrefix), ":")
+	if len(ts) != 2 {
+		return nil, nil, errors.New("invalid signature line")
+	}
+	pub, err1 := base64.StdEncoding.DecodeString(ts[0])
+	sig, err2 := base64.StdEncoding.DecodeString(ts[1])
+	if err1 != nil || err2 != nil || len(pub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return nil, nil, errors.New("invalid signature line")
+	}
+	return pub, sig, nil
+}
+
+// validManifest checks manifest lines of putIndex. Root is not compared with
+// blocks, replicas of ec store descriptors and the root of the file blocks.
+func validManifest(lines []string) error {
+	for _, line := range lines {
+		var err error
+		switch {
+		case strings.HasPrefix(line, rootPrefix):
+			err = validHash(line[len(rootPrefix):])
+		case strings.HasPrefix(line, sigPrefix):
+			_, _, err = parseSig(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal sets root of file and signs it when sign key is set
+func (uri *URI) seal(fi *fileInfo) error {
+	fi.root = merkleRoot(fi.blocks)
+	fi.sigs = nil
+	key, err := uri.signKey()
+	if key == nil {
+		return err
+	}
+	sig := ed25519.Sign(key, signedMessage(fi.name, fi.size, fi.root))
+	pub := key.Public().(ed25519.PublicKey)
+	fi.sigs = []string{sigPrefix + base64.StdEncoding.EncodeToString(pub) + ":" + base64.StdEncoding.EncodeToString(sig)}
+	return nil
+}
+
+// verify checks root of file and when trusted keys are set a signature by one of them
+func (uri *URI) verify(fi *fileInfo) error {
+	if fi.root != "" && fi.root != merkleRoot(fi.blocks) {
+		return ErrManifest
+	}
+	keys, err := uri.trustedKeys()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	if fi.root == "" {
+		return ErrNotSigned
+	}
+	msg := signedMessage(fi.name, fi.size, fi.root)
+	for _, line := range fi.sigs {
+		pub, sig, err := parseSig(line)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if bytes.Equal(key, pub) && ed25519.Verify(pub, msg, sig) {
+				return nil
+			}
+		}
+	}
+	return ErrNotSigned
+}
+
+// keyPath returns configured path or default path next to config file
+func keyPath(path, name string) (string, bool) {
+	if path != "" {
+		return path, true
+	}
+	return filepath.Dir(configPath()) + "/" + name, false
+}
+
+// signKey reads ed25519 key of sign-key, a base64 seed. It is nil without key.
+func (uri *URI) signKey() (ed25519.PrivateKey, error) {
+	path, configured := keyPath(uri.signkey, "sign.key")
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !configured {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(bs)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New(path + ": invalid sign key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// trustedKeys reads public keys of trusted-keys, a base64 key and a comment on each line
+func (uri *URI) trustedKeys() ([]ed25519.PublicKey, error) {
+	path, configured := keyPath(uri.trusted, "trusted_keys")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !configured {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []ed25519.PublicKey
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		ts := strings.Fields(scanner.Text())
+		if len(ts) == 0 || ts[0][0] == '#' {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(ts[0])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid public key", path, n)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// cmdKeygen writes a new sign key and prints its public key for trusted_keys
+func cmdKeygen(args []string) error {
+	path, _ := keyPath("", "sign.key")
+	if len(args) > 0 {
+		path = args[0]
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(path), 0700)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(key.Seed()))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	fmt.Println(base64.StdEncoding.EncodeToString(pub), os.Getenv("USER")+"@"+host)
+	return nil
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latency buckets in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+type histogram struct {
+	counts []int64 // per bucket, last one is +Inf
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics of bfst serve in Prometheus text format
+type metrics struct {
+	mu       sync.Mutex
+	requests map[[2]string]int64 // cmd, status ok, error, denied or invalid
+	latency  map[string]*histogram
+	dedups   map[string]int64    // stored, new
+	caches   map[[2]string]int64 // cache, hit or miss
+	bytesIn  int64
+	bytesOut int64
+	lockWait time.Duration
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[[2]string]int64),
+		latency:  make(map[string]*histogram),
+		dedups:   make(map[string]int64),
+		caches:   make(map[[2]string]int64),
+	}
+}
+
+// metricCmd returns label of command, commands which are not known are invalid
+// so clients can not add labels
+func metricCmd(cmd string) string {
+	if _, ok := cmdPerms[cmd]; ok || cmd == "hello" || cmd == "auth" {
+		return cmd
+	}
+	return "invalid"
+}
+
+// labelEscaper escapes label values of text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metrics) request(cmd string, err error, in, out int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if metricCmd(cmd) == "invalid" {
+		m.rejected(cmd, "invalid", in)
+		return
+	}
+	status := "ok"
+	if errors.Is(err, ErrPermission) {
+		status = "denied"
+	} else if err != nil {
+		status = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{cmd, status}]++
+	h := m.latency[cmd]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+		m.latency[cmd] = h
+	}
+	h.observe(d.Seconds())
+	m.bytesIn += int64(in)
+	m.bytesOut += int64(out)
+}
+
+// rejected counts request which is denied or invalid before it is run
+func (m *metrics) rejected(cmd, status string, in int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.requests[[2]string{metricCmd(cmd), status}]++
+	m.bytesIn += int64(in)
+	m.mu.Unlock()
+}
+
+// dedup counts blocks of put and hasBlocks, stored blocks are not sent again
+func (m *metrics) dedup(stored bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if stored {
+		m.dedups["stored"]++
+	} else {
+		m.dedups["new"]++
+	}
+	m.mu.Unlock()
+}
+
+// cache counts lookups of a cache of serve
+func (m *metrics) cache(name string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.mu.Lock()
+	m.caches[[2]string{name, result}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) waited(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.lockWait += d
+	m.mu.Unlock()
+}
+
+func (m *metrics) write(w io.Writer, st *storeStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP bfst_requests_total Requests by command and status.")
+	fmt.Fprintln(w, "# TYPE bfst_requests_total counter")
+	var keys [][2]string
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "bfst_requests_total{cmd=\"%s\",status=\"%s\"} %d\n", labelEscaper.Replace(k[0]), k[1], m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP bfst_request_duration_seconds Latency of requests by command.")
+	fmt.Fprintln(w, "# TYPE bfst_request_duration_seconds histogram")
+	var cmds []string
+	for cmd := range m.latency {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		h := m.latency[cmd]
+		cmd = labelEscaper.Replace(cmd)
+		var n int64
+		for i, c := range h.counts {
+			n += c
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "bfst_request_duration_seconds_bucket{cmd=\"%s\",le=\"%s\"} %d\n", cmd, le, n)
+		}
+		fmt.Fprintf(w, "bfst_request_duration_seconds_sum{cmd=\"%s\"} %g\n", cmd, h.sum)
+		fmt.Fprintf(w, "bfst_request_duration_seconds_count{cmd=\"%s\"} %d\n", cmd, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP bfst_received_bytes_total Bytes of requests.")
+	fmt.Fprintln(w, "# TYPE bfst_received_bytes_total counter")
+	fmt.Fprintf(w, "bfst_received_bytes_total %d\n", m.bytesIn)
+	fmt.Fprintln(w, "# HELP bfst_sent_bytes_total Bytes of replies.")
+	fmt.Fprintln(w, "# TYPE bfst_sent_bytes_total counter")
+	fmt.Fprintf(w, "bfst_sent_bytes_total %d\n", m.bytesOut)
+	fmt.Fprintln(w, "# HELP bfst_lock_wait_seconds_total Time waited for index lock.")
+	fmt.Fprintln(w, "# TYPE bfst_lock_wait_seconds_total counter")
+	fmt.Fprintf(w, "bfst_lock_wait_seconds_total %g\n", m.lockWait.Seconds())
+	fmt.Fprintln(w, "# HELP bfst_dedup_lookups_total Blocks of put looked up in index, stored blocks are deduped.")
+	fmt.Fprintln(w, "# TYPE bfst_dedup_lookups_total counter")
+	fmt.Fprintf(w, "bfst_dedup_lookups_total{result=\"stored\"} %d\n", m.dedups["stored"])
+	fmt.Fprintf(w, "bfst_dedup_lookups_total{result=\"new\"} %d\n", m.dedups["new"])
+	fmt.Fprintln(w, "# HELP bfst_cache_lookups_total Lookups of visible blocks of clients and of stats by result.")
+	fmt.Fprintln(w, "# TYPE bfst_cache_lookups_total counter")
+	for _, name := range []string{"visible", "stats"} {
+		for _, result := range []string{"hit", "miss"} {
+			fmt.Fprintf(w, "bfst_cache_lookups_total{cache=\"%s\",result=\"%s\"} %d\n", name, result, m.caches[[2]string{name, result}])
+		}
+	}
+
+	if st == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP bfst_files Stored files.")
+	fmt.Fprintln(w, "# TYPE bfst_files gauge")
+	fmt.Fprintf(w, "bfst_files %d\n", st.Files)
+	fmt.Fprintln(w, "# HELP bfst_blocks Stored blocks.")
+	fmt.Fprintln(w, "# TYPE bfst_blocks gauge")
+	fmt.Fprintf(w, "bfst_blocks %d\n", st.Blocks)
+	fmt.Fprintln(w, "# HELP bfst_store_bytes Size of store, logical is size of files and physical is size of blocks.")
+	fmt.Fprintln(w, "# TYPE bfst_store_bytes gauge")
+	fmt.Fprintf(w, "bfst_store_bytes{kind=\"logical\"} %d\n", st.Logical)
+	fmt.Fprintf(w, "bfst_store_bytes{kind=\"physical\"} %d\n", st.Physical)
+	fmt.Fprintln(w, "# HELP bfst_dedup_ratio Logical size divided by referenced size.")
+	fmt.Fprintln(w, "# TYPE bfst_dedup_ratio gauge")
+	fmt.Fprintf(w, "bfst_dedup_ratio %g\n", st.Ratio)
+}
+
+// metricsHandler serves /metrics of served store
+func (uri *URI) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		st := uri.metricsStats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		uri.metrics.write(w, st)
+	})
+	return mux
+}
+
+// metricsStats returns a copy of stats of store, they are cached in shared index
+// until files change and new blocks are added to them. It is nil on error.
+func (uri *URI) metricsStats() *storeStats {
+	s := uri.shared
+	s.mu.Lock()
+	if s.stats != nil {
+		st := *s.stats
+		s.mu.Unlock()
+		uri.metrics.cache("stats", true)
+		return &st
+	}
+	changes := s.changes
+	s.mu.Unlock()
+	uri.metrics.cache("stats", false)
+
+	files, err := uri.localListFiles(nil)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := fileStats(files, nil, s.index)
+	if s.changes == changes {
+		s.stats = st
+	}
+	ret := *st
+	return &ret
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseMirror parses the replica list of a mirror or ec URI
+//
+//	mirror:(uri1,uri2[,quorum=N])
+//	ec:(uri1,uri2,uri3[,parity=M][,quorum=N])
+//	mirror:listfile, one uri or option per line
+func parseMirror(uri *URI, str string) *URI {
+	var items []string
+	if len(str) > 1 && str[0] == '(' && str[len(str)-1] == ')' {
+		// split by top level comma, nested mirror is allowed
+		depth := 0
+		last := 1
+		for i := 1; i < len(str)-1; i++ {
+			switch str[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			case ',':
+				if depth == 0 {
+					items = append(items, str[last:i])
+					last = i + 1
+				}
+			}
+		}
+		items = append(items, str[last:len(str)-1])
+	} else {
+		bs, err := ioutil.ReadFile(str)
+		if err != nil {
+			return nil
+		}
+		items = strings.Split(string(bs), "\n")
+	}
+
+	for _, item := range items {
+		item = strings.Trim(item, " \t\r")
+		if item == "" || item[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(item, "quorum=") {
+			n, err := strconv.Atoi(item[7:])
+			if err != nil || n < 1 {
+				return nil
+			}
+			uri.quorum = n
+			continue
+		}
+		if strings.HasPrefix(item, "parity=") && uri.proto == "ec" {
+			n, err := strconv.Atoi(item[7:])
+			if err != nil || n < 0 {
+				return nil
+			}
+			uri.parity = n
+			continue
+		}
+		r := parseURI(item)
+		if r == nil {
+			return nil
+		}
+		uri.replicas = append(uri.replicas, r)
+	}
+	if len(uri.replicas) == 0 {
+		return nil
+	}
+	if uri.proto == "ec" {
+		// every shard is needed to keep full redundancy
+		if uri.parity >= len(uri.replicas) {
+			return nil
+		}
+		if uri.quorum == 0 {
+			uri.quorum = len(uri.replicas)
+		}
+		if uri.quorum < len(uri.replicas)-uri.parity {
+			return nil
+		}
+	}
+	if uri.quorum == 0 {
+		uri.quorum = len(uri.replicas)/2 + 1
+	}
+	if uri.quorum > len(uri.replicas) {
+		return nil
+	}
+	uri.path = str
+	return uri
+}
+
+// inherit passes concurrency, limits and encryption key of a mirror or ec store
+// to its replicas, which keep their own settings
+func (uri *URI) inherit() {
+	for _, r := range uri.replicas {
+		if r.concurrency == 0 {
+			r.concurrency = uri.concurrency
+		}
+		if r.limiter == nil {
+			r.limiter = uri.limiter
+		}
+		if r.retry == nil {
+			r.retry = uri.retry
+		}
+		if r.cipher == nil {
+			r.cipher = uri.cipher
+		}
+		r.inherit()
+	}
+}
+
+// mirrorAll runs fn on every replica, it fails when less than quorum replicas succeed
+func (uri *URI) mirrorAll(fn func(r *URI) error) error {
+	cnt := 0
+	var lastErr error
+	for _, r := range uri.replicas {
+		err := fn(r)
+		if err != nil {
+			Warn(r.str() + " " + err.Error())
+			lastErr = err
+			continue
+		}
+		cnt++
+	}
+	if cnt < uri.quorum {
+		return fmt.Errorf("quorum not reached %d/%d: %v", cnt, uri.quorum, lastErr)
+	}
+	return nil
+}
+
+// mirrorIndex returns blocks available on all reachable replicas
+func (uri *URI) mirrorIndex() (map[string]int, error) {
+	var index map[string]int
+	var lastErr error
+	cnt := 0
+	for _, r := range uri.replicas {
+		ri, err := r.allIndex()
+		if err != nil {
+			Warn(r.str() + " " + err.Error())
+			lastErr = err
+			continue
+		}
+		cnt++
+		if index == nil {
+			index = ri
+			continue
+		}
+		for hash := range index {
+			if _, ok := ri[hash]; !ok {
+				delete(index, hash)
+			}
+		}
+	}
+	if cnt < uri.quorum {
+		return nil, fmt.Errorf("quorum not reached %d/%d: %v", cnt, uri.quorum, lastErr)
+	}
+	return index, nil
+}
+
+// mirrorFiles merges file lists of all replicas, newest file wins
+func (uri *URI) mirrorFiles(flags []string) ([]*fileInfo, error) {
+	files := make(map[string]*fileInfo)
+	cnt := 0
+	var lastErr error
+	for _, r := range uri.replicas {
+		ret, err := r.getIndex(flags)
+		if err != nil {
+			Warn(r.str() + " " + err.Error())
+			lastErr = err
+			continue
+		}
+		cnt++
+		for _, file := range getFiles(strings.Split(string(ret), "\n")) {
+			if f, ok := files[file.name]; !ok || f.mtime.Before(file.mtime) {
+				files[file.name] = file
+			}
+		}
+	}
+	if cnt == 0 {
+		return nil, lastErr
+	}
+
+	var result []*fileInfo
+	for _, file := range files {
+		result = append(result, file)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result, nil
+}
+
+// mirrorGetBlock reads block from the first replica which has a valid copy
+func (uri *URI) mirrorGetBlock(hash string) ([]byte, error) {
+	var lastErr error
+	for _, r := range uri.replicas {
+		bs, err := r.getBlock(hash)
+		if err == nil {
+			err = checkBlock(hash, bs)
+			if err == nil {
+				return bs, nil
+			}
+		}
+		Warn(r.str() + " " + err.Error())
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (uri *URI) mirrorRm(flags []string) ([]byte, error) {
+	var ret []byte
+	err := uri.mirrorAll(func(r *URI) error {
+		bs, err := r.rm(flags)
+		if err == nil && ret == nil {
+			ret = bs
+		}
+		return err
+	})
+	return ret, err
+}
@@ -0,0 +1,1231 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const BFST_HELLO = "BFSTv1.0"
+const NOSUPPORT = " is not supported"
+
+//URI struct of file store config
+type URI struct {
+	proto, user, host, port, path string
+
+	// settings from config file
+	identity, cachedir string
+	bindir, ca         string
+	cert, key, token   string
+	signkey, trusted   string
+	nocompress         bool
+	noupgrade          bool
+	limiter            *rateLimiter
+	retry              *retryPolicy
+	concurrency        int // blocks in flight of put and get
+	cipher             *blockCipher
+
+	// internal
+	ecnt int
+	algo string          // hash of new blocks
+	ctx  context.Context // of Client call, remote requests are aborted when it is done
+	out  output          // of command line commands
+
+	// ssh internal
+	echan         chan error
+	stdin, stdout chan []byte
+	activity      chan struct{}
+	version       string
+	features      map[string]string
+	exe           string // sha256 and os/arch of remote bfst
+	exeVersion    string // version of remote bfst, "" before it is reported
+	pool          []*URI // more connections of concurrency
+	upgraded      bool
+	crc           *int32
+
+	// serve internal
+	shared    *sharedIndex
+	client    *client
+	metrics   *metrics
+	quotaUsed map[string]int64 // of checkQuotaBlock without shared index
+
+	// mirror internal
+	replicas []*URI
+	quorum   int
+
+	// ec internal
+	parity           int
+	ecdesc, ecblocks map[string]*stripe
+}
+
+//parseURI
+//support
+//  user@domain:port/path
+//  ssh://user@domain:port/path
+//  http://user@domain:port/path
+//  https://user@domain:port/path
+//  tls://domain:port, bfst serve
+//  file:path
+//  mirror:(uri1,uri2,...)
+//  mirror:listfile
+//  ec:(uri1,uri2,uri3,parity=1)
+//  @name, remote in config file
+func parseURI(str string) *URI {
+	if strings.HasPrefix(str, "@") && !strings.ContainsAny(str, "/:") {
+		uri, err := configURI(str[1:])
+		if err != nil {
+			Warn(err.Error())
+			return nil
+		}
+		return uri
+	}
+
+	uri := new(URI)
+	n := strings.Index(str, ":")
+	if n < 0 {
+		if strings.Index(str, "@") < 0 {
+			return nil
+		}
+		uri.proto = "ssh"
+	} else if strings.Index(str[:n], "@") < 0 {
+		uri.proto = str[:n]
+		str = str[n+1:]
+	} else {
+		uri.proto = "ssh"
+	}
+	// remove // in uri
+	if len(str) > 2 && str[:2] == "//" {
+		str = str[2:]
+	}
+
+	if uri.proto == "file" {
+		uri.path = str
+		return uri
+	}
+	if uri.proto == "mirror" || uri.proto == "ec" {
+		return parseMirror(uri, str)
+	}
+
+	n = strings.Index(str, "/")
+	if n > 0 {
+		uri.path = str[n+1:]
+		str = str[:n]
+	}
+	n = strings.LastIndex(str, ":")
+	if n > 0 {
+		uri.port = str[n+1:]
+		str = str[:n]
+	}
+	n = strings.Index(str, "@")
+	if n < 0 {
+		uri.host = str
+	} else {
+		uri.user = str[:n]
+		uri.host = str[n+1:]
+	}
+	return uri
+}
+
+func (uri *URI) str() string {
+	if uri.proto == "file" || uri.proto == "mirror" || uri.proto == "ec" {
+		return uri.proto + ":" + uri.path
+	}
+	user := ""
+	if uri.user != "" {
+		user = uri.user + "@"
+	}
+	port := ""
+	if uri.port != "" {
+		port = ":" + uri.port
+	}
+	return fmt.Sprintf("%s://%s%s%s/%s", uri.proto, user, uri.host, port, uri.path)
+}
+
+type pipeIO struct {
+	ch chan []byte
+	dt []byte
+
+	// act is signaled when data is written
+	act chan struct{}
+
+	// crc is not 0 when crc frames are agreed, errc gets corrupted frames
+	crc  *int32
+	errc chan error
+
+	// hello is true until BFST_HELLO is found, data before it is noise
+	hello bool
+}
+
+// Read for cmd.stdin
+func (p *pipeIO) Read(data []byte) (n int, err error) {
+	for {
+		n = len(p.dt)
+		if n > len(data) {
+			n = len(data)
+			copy(data, p.dt[:n])
+			p.dt = p.dt[n:]
+			return
+		} else if n > 0 {
+			copy(data, p.dt)
+			p.dt = nil
+			return
+		}
+		if p.ch == nil {
+			err = io.EOF
+			return
+		}
+		dt := <-p.ch
+		if dt == nil {
+			p.ch = nil
+			err = io.EOF
+			return
+		}
+		if p.crc != nil && atomic.LoadInt32(p.crc) != 0 {
+			p.dt = crcFrame(dt)
+		} else {
+			p.dt = append(frameHeader(len(dt)), dt...)
+		}
+	}
+}
+
+// Write for cmd.stdout
+func (p *pipeIO) Write(data []byte) (n int, err error) {
+	//fmt.Fprintf(os.Stderr, "#write %d\n", len(data))
+
+	n = len(data)
+	if data == nil {
+		p.ch <- data
+		return
+	}
+	if p.act != nil {
+		select {
+		case p.act <- struct{}{}:
+		default:
+		}
+	}
+
+	p.dt = append(p.dt, data...)
+
+	if p.crc != nil && atomic.LoadInt32(p.crc) != 0 {
+		for len(p.dt) > 0 {
+			dt, used, ferr := nextCRCFrame(p.dt, bigFrame)
+			p.dt = p.dt[used:]
+			if ferr != nil {
+				select {
+				case p.errc <- ferr:
+				default:
+				}
+			}
+			if dt != nil {
+				p.ch <- dt
+			} else if used == 0 {
+				break
+			}
+		}
+		return
+	}
+
+	// search block start, discard unknown data
+	for {
+		if p.dt[0] == frameMagic {
+			if !p.hello {
+				break
+			}
+			if len(p.dt) < 9 {
+				return
+			}
+			if string(p.dt[4:9]) == BFST_HELLO[:5] {
+				p.hello = false
+				break
+			}
+		}
+		p.dt = p.dt[1:]
+		if len(p.dt) == 0 {
+			return
+		}
+	}
+
+	// get data
+	for len(p.dt) > 0 {
+		hsz, sz, ferr := frameSize(p.dt, bigFrame)
+		if ferr != nil {
+			return 0, ferr
+		}
+		if hsz == 0 || sz > len(p.dt)-hsz {
+			return
+		}
+		p.ch <- p.dt[hsz : hsz+sz]
+		if sz == len(p.dt)-hsz {
+			p.dt = nil
+		} else {
+			p.dt = p.dt[hsz+sz:]
+		}
+	}
+	return
+}
+
+func (uri *URI) cmds(cmd string) []string {
+	cmds := []string{"-T"}
+	if !uri.nocompress {
+		cmds = append(cmds, "-C")
+	}
+	if uri.identity != "" {
+		cmds = append(cmds, "-i", uri.identity)
+	}
+	if uri.port != "" {
+		cmds = append(cmds, "-p", uri.port)
+	}
+	if uri.path != "" {
+		cmd = "cd " + uri.path + "; " + cmd
+	}
+	cmds = append(cmds, uri.user+"@"+uri.host, cmd)
+	return cmds
+}
+
+func (uri *URI) runSSH(cmd string, stdin []byte) ([]byte, error) {
+	cmds := uri.cmds(cmd)
+	p := exec.Command("ssh", cmds...)
+	stdout := &bytes.Buffer{}
+	if stdin != nil {
+		p.Stdin = bytes.NewReader(stdin)
+	}
+	p.Stdout = stdout
+	p.Stderr = warnWriter{}
+	err := p.Run()
+	return stdout.Bytes(), err
+}
+
+func (uri *URI) runSSH0(cmd string) error {
+	cmds := uri.cmds(cmd)
+	p := exec.Command("ssh", cmds...)
+	if uri.out == textOutput {
+		// progress of remote init
+		p.Stdout = os.Stdout
+	}
+	p.Stderr = warnWriter{}
+	return p.Run()
+}
+
+func (uri *URI) runRemote(cmd string, stdin []byte) ([]byte, error) {
+	rp := uri.retryPolicy()
+	if uri.ctx != nil && uri.ctx.Err() != nil {
+		return nil, uri.ctx.Err()
+	}
+	if uri.stdin == nil {
+		uri.open()
+	}
+	sent := false
+	for uri.ecnt < rp.retries {
+		if uri.stdin != nil {
+			if sent && !idempotent[cmd] {
+				return nil, fmt.Errorf("%s %w", cmd, ErrUncertain)
+			}
+			b := []byte{byte(len(cmd))}
+			b = append(b, []byte(cmd)...)
+			b = append(b, stdin...)
+			if len(b) > uri.maxFrame() {
+				return nil, fmt.Errorf("%s %w: %d bytes", cmd, ErrFrameTooLarge, len(b))
+			}
+			uri.stdin <- b
+			sent = true
+
+			//fmt.Fprintf(os.Stderr, "< %d\n", len(b))
+
+			// timer restarts when reply data arrives
+			timeout := rp.replyTimeout(cmd, len(stdin))
+			timer := time.NewTimer(timeout)
+		wait:
+			for {
+				select {
+				case b = <-uri.stdout:
+					//fmt.Fprintf(os.Stderr, "> %d\n", len(b))
+					timer.Stop()
+					if b != nil {
+						uri.ecnt = 0
+						if len(b) > 3 && string(b[:3]) == "E: " {
+							return nil, &RemoteError{string(b[3:])}
+						}
+						return b, nil
+					}
+					break wait
+				case <-uri.activity:
+					if !timer.Stop() {
+						<-timer.C
+					}
+					timer.Reset(timeout)
+				case <-uri.echan:
+					timer.Stop()
+					break wait
+				case <-timer.C:
+					break wait
+				case <-uri.done():
+					// reply would be taken for the one of next request
+					timer.Stop()
+					uri.close()
+					return nil, uri.ctx.Err()
+				}
+			}
+		}
+		uri.ecnt++
+		if uri.ecnt >= rp.retries {
+			break
+		}
+		delay := rp.delay(uri.ecnt)
+		msg := fmt.Sprintf("retry %d in %v", uri.ecnt, delay.Round(time.Millisecond))
+		uri.close()
+		select {
+		case <-time.After(delay):
+		case <-uri.done():
+			return nil, uri.ctx.Err()
+		}
+		err := uri.open()
+		if err != nil {
+			msg += " " + err.Error()
+		}
+		Warn(msg)
+	}
+	return nil, errors.New("too many retries")
+}
+
+// done returns channel of context of uri, it is nil without context
+func (uri *URI) done() <-chan struct{} {
+	if uri.ctx == nil {
+		return nil
+	}
+	return uri.ctx.Done()
+}
+
+// setContext sets context of uri and its replicas, nil removes it
+func (uri *URI) setContext(ctx context.Context) {
+	uri.ctx = ctx
+	for _, r := range append(uri.replicas, uri.pool...) {
+		r.setContext(ctx)
+	}
+}
+
+// workers returns uri and connections of the same remote store, one for each
+// block in flight. A mirror worker uses a connection of each replica, so all
+// replicas need as many connections. Other stores have no concurrency.
+func (uri *URI) workers() []*URI {
+	if uri.concurrency <= 1 {
+		return []*URI{uri}
+	}
+	switch uri.proto {
+	case "ssh", "tls":
+		for len(uri.pool) < uri.concurrency-1 {
+			c := *uri
+			c.stdin, c.stdout, c.activity, c.echan, c.crc = nil, nil, nil, nil, nil
+			c.ecnt, c.pool = 0, nil
+			// remote bfst is upgraded by first connection only
+			c.upgraded = true
+			uri.pool = append(uri.pool, &c)
+		}
+
+	case "mirror":
+		for len(uri.pool) < uri.concurrency-1 {
+			c := *uri
+			c.replicas, c.pool = nil, nil
+			for _, r := range uri.replicas {
+				ws := r.workers()
+				if len(ws) < uri.concurrency {
+					return []*URI{uri}
+				}
+				c.replicas = append(c.replicas, ws[len(uri.pool)+1])
+			}
+			uri.pool = append(uri.pool, &c)
+		}
+
+	default:
+		return []*URI{uri}
+	}
+	return append([]*URI{uri}, uri.pool...)
+}
+
+// closeAll closes connections of uri, its replicas and workers
+func (uri *URI) closeAll() {
+	uri.close()
+	for _, r := range append(uri.replicas, uri.pool...) {
+		r.closeAll()
+	}
+}
+
+func (uri *URI) open() (err error) {
+	if uri.proto == "ssh" || uri.proto == "tls" {
+		uri.close()
+		stdin := make(chan []byte)
+		stdout := make(chan []byte, 10)
+		activity := make(chan struct{}, 1)
+		echan := make(chan error, 2)
+		crc := new(int32)
+		uri.stdin, uri.stdout, uri.activity, uri.echan, uri.crc = stdin, stdout, activity, echan, crc
+		in := &pipeIO{ch: stdin, crc: crc}
+		out := &pipeIO{ch: stdout, act: activity, crc: crc, errc: echan, hello: true}
+		if uri.proto == "tls" {
+			go func() {
+				echan <- uri.dialTLS(in, out)
+			}()
+		} else {
+			cmds := uri.cmds("./bfst .")
+			go func() {
+				p := exec.Command("ssh", cmds...)
+				p.Stdin = in
+				p.Stdout = out
+				p.Stderr = warnWriter{}
+				echan <- p.Run()
+			}()
+		}
+
+		select {
+		case ret := <-uri.stdout:
+			// later 1.x servers are negotiated by hello
+			if !strings.HasPrefix(string(ret), "BFSTv1.") {
+				err = errors.New("invalid BFST_HELLO")
+			} else {
+				err = uri.hello()
+			}
+		case err = <-uri.echan:
+		case <-time.After(uri.retryPolicy().hello):
+			err = errors.New("BFST_HELLO timed out")
+		}
+		if err != nil {
+			uri.close()
+			return errors.New(uri.proto + " failed: " + err.Error())
+		}
+		if uri.token != "" {
+			_, err = uri.call("auth", []byte(uri.token))
+			if err != nil {
+				uri.close()
+				return errors.New("auth failed: " + err.Error())
+			}
+		}
+		if uri.proto == "ssh" && !uri.noupgrade && !uri.upgraded {
+			uri.upgraded = true
+			ok, err := uri.upgrade()
+			if err != nil {
+				Warn("upgrade remote bfst: " + err.Error())
+			}
+			if ok {
+				return uri.open()
+			}
+		}
+	}
+	return
+}
+
+func (uri *URI) close() {
+	if uri.stdin != nil {
+		uri.stdin <- nil
+	}
+	uri.stdin = nil
+}
+
+func (uri *URI) init() error {
+	switch uri.proto {
+	case "ssh":
+		{
+			ret, err := uri.runSSH("pwd", nil)
+			if err != nil {
+				return errors.New("ssh failed: " + err.Error())
+			}
+			str := strings.Trim(string(ret), " \t\r\n")
+			subdir := uri.user
+			if len(uri.path) > 0 {
+				subdir += "/" + uri.path
+			}
+			if !strings.HasSuffix(str, subdir) {
+				// run mkdir in home directory
+				uri.runSSH("mkdir -p "+uri.path, nil)
+			}
+
+			// put bfst to directory
+			elf, err := uri.remoteBinary()
+			if err != nil {
+				return err
+			}
+			uri.out.printStatus("put bfst")
+			err = uri.putBinary(elf)
+			if err != nil {
+				return err
+			}
+
+			cmd := "./bfst .init"
+			if uri.algo != "" {
+				cmd += " " + uri.algo
+			}
+			err = uri.runSSH0(cmd)
+			if err != nil {
+				return errors.New("bfst init error")
+			}
+			return uri.open()
+		}
+
+	case "file":
+		{
+			os.MkdirAll(uri.path, 0755)
+			if uri.algo != "" {
+				err := validAlgo(uri.algo)
+				if err != nil {
+					return err
+				}
+				ioutil.WriteFile(uri.path+"/"+HASHFILE, []byte(uri.algo+"\n"), 0644)
+			}
+			ioutil.WriteFile(uri.path+"/index", []byte(""), 0644)
+			ioutil.WriteFile(uri.path+"/"+LOCKFILE, []byte(""), 0644)
+
+			index, err := uri.allIndex()
+			if err != nil {
+				return err
+			}
+			// blocks of all hashes are kept, hash file selects hash of new blocks
+			for _, prefix := range hashPrefixes {
+				for i := 0; i < 256; i++ {
+					uri.out.initProgress(i, len(index))
+					uri.localInit(prefix, fmt.Sprintf("%02x", i), index)
+				}
+			}
+			uri.out.progressEnd()
+			err = uri.localWriteIndex(index)
+			os.Remove(uri.path + "/" + LOCKFILE)
+			uri.audit("init", nil, 0)
+			return err
+		}
+
+	case "mirror", "ec":
+		return uri.mirrorAll(func(r *URI) error {
+			r.algo, r.out = uri.algo, uri.out
+			return r.init()
+		})
+
+	default:
+		return errors.New(uri.proto + NOSUPPORT)
+	}
+
+}
+
+func (uri *URI) allIndex() (map[string]int, error) {
+	var ret []byte
+	var err error
+	switch uri.proto {
+	case "ssh", "tls":
+		if uri.proto == "ssh" && uri.stdin == nil {
+			uri.open()
+		}
+		// forced command of ssh allows only bfst
+		if uri.proto == "tls" || uri.has("index") {
+			ret, err = uri.runRemote("index", nil)
+		} else {
+			ret, err = uri.runSSH("cat index", nil)
+		}
+
+	case "file":
+		if uri.shared != nil {
+			return uri.shared.copy(), nil
+		}
+		ret, err = ioutil.ReadFile(uri.path + "/index")
+		if os.IsNotExist(err) {
+			return nil, ErrNoIndex
+		}
+
+	case "mirror":
+		return uri.mirrorIndex()
+
+	case "ec":
+		return uri.ecIndex()
+
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for _, txt := range strings.Split(string(ret), "\n") {
+		n := strings.Index(txt, " ")
+		if n < 0 {
+			continue
+		}
+		sz, err := strconv.Atoi(txt[n+1:])
+		if err != nil {
+			continue
+		}
+		index[txt[:n]] = sz
+	}
+	return index, nil
+}
+
+func (uri *URI) ls(flags []string) ([]byte, error) {
+	switch uri.proto {
+	case "ssh", "tls":
+		return uri.runRemote("ls", []byte(strings.Join(flags, "\n")))
+
+	case "file":
+		{
+			files, err := uri.localListFiles(flags)
+			if err != nil {
+				return nil, err
+			}
+			ret := ""
+			for _, file := range files {
+				ret += file.line()
+			}
+			return []byte(ret), nil
+
+		}
+	case "mirror", "ec":
+		{
+			listFiles := uri.mirrorFiles
+			if uri.proto == "ec" {
+				listFiles = uri.ecFiles
+			}
+			files, err := listFiles(flags)
+			if err != nil {
+				return nil, err
+			}
+			ret := ""
+			for _, file := range files {
+				ret += file.line()
+			}
+			return []byte(ret), nil
+		}
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+func (uri *URI) getIndex(flags []string) ([]byte, error) {
+	switch uri.proto {
+	case "ssh", "tls":
+		return uri.runRemote("getIndex", []byte(strings.Join(flags, "\n")))
+
+	case "file":
+		{
+			files, err := uri.localListFiles(flags)
+			if err != nil {
+				return nil, err
+			}
+			ret := ""
+			for _, file := range files {
+				ret += file.index()
+			}
+			return []byte(ret), nil
+		}
+
+	case "mirror", "ec":
+		{
+			listFiles := uri.mirrorFiles
+			if uri.proto == "ec" {
+				listFiles = uri.ecFiles
+			}
+			files, err := listFiles(flags)
+			if err != nil {
+				return nil, err
+			}
+			ret := ""
+			for _, file := range files {
+				ret += file.index()
+			}
+			return []byte(ret), nil
+		}
+
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+func (uri *URI) putIndex(lines []string) error {
+	switch uri.proto {
+	case "ssh", "tls":
+		{
+			if uri.stdin == nil {
+				uri.open()
+			}
+			if blocks := indexBlocks(lines[1:]); !uri.has("manifest") && len(blocks) < len(lines)-1 {
+				// old bfst does not accept manifest lines
+				Warn(uri.str() + " stores no root and signature of files, remote bfst is too old")
+				lines = append([]string{lines[0]}, blocks...)
+			}
+			_, err := uri.runRemote("putIndex", []byte(strings.Join(lines, "\n")))
+			if errors.Is(err, ErrUncertain) {
+				// send again only when it is not applied
+				ts := strings.Split(lines[0], " ")
+				fi, serr := uri.stat(ts[0])
+				if serr == nil && strings.Join(fi.blocks, "\n") == strings.Join(indexBlocks(lines[1:]), "\n") {
+					return nil
+				}
+				if serr != nil && !errors.Is(serr, ErrNotFound) {
+					return err
+				}
+				_, err = uri.runRemote("putIndex", []byte(strings.Join(lines, "\n")))
+			}
+			return err
+		}
+	case "file":
+		{
+			return uri.localPutIndex(lines)
+		}
+	case "mirror":
+		return uri.mirrorAll(func(r *URI) error { return r.putIndex(lines) })
+	case "ec":
+		return uri.ecPutIndex(lines)
+	default:
+		return errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+func (uri *URI) getBlock(hash string) ([]byte, error) {
+	switch uri.proto {
+	case "ssh", "tls":
+		return uri.runRemote("getBlock", []byte(hash))
+	case "file":
+		{
+			err := validHash(hash)
+			if err != nil {
+				return nil, err
+			}
+			path, fn := blockPath(hash)
+			return ioutil.ReadFile(uri.path + "/" + path + "/" + fn)
+		}
+	case "mirror":
+		return uri.mirrorGetBlock(hash)
+	case "ec":
+		return uri.ecGetBlock(hash)
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+func (uri *URI) putBlock(data []byte) error {
+	switch uri.proto {
+	case "ssh", "tls":
+		{
+			_, err := uri.runRemote("putBlock", data)
+			return err
+		}
+
+	case "file":
+		return uri.putBlockID(blockID(uri.hashAlgo(), data), data)
+
+	case "mirror":
+		return uri.mirrorAll(func(r *URI) error { return r.putBlock(data) })
+
+	case "ec":
+		return uri.ecPutBlock(uri.hashAlgo(), data)
+
+	default:
+		return errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+// putBlockID stores block with id of its hash, which may differ from hash of new blocks
+// of the store. Caller has checked id of data.
+func (uri *URI) putBlockID(hash string, data []byte) error {
+	switch uri.proto {
+	case "ssh", "tls":
+		{
+			if idAlgo(hash) == uri.hashAlgo() {
+				_, err := uri.runRemote("putBlock", data)
+				return err
+			}
+			if !uri.has("putBlockID") {
+				return fmt.Errorf("%s %w by remote bfst", idAlgo(hash), ErrUnknownHash)
+			}
+			_, err := uri.runRemote("putBlockID", append([]byte(hash+"\n"), data...))
+			return err
+		}
+
+	case "file":
+		{
+			// quota is checked under lock of index, so clients can not pass it together
+			var index map[string]int
+			var used *map[string]int64
+			if uri.shared != nil {
+				tm := time.Now()
+				uri.shared.mu.Lock()
+				defer uri.shared.mu.Unlock()
+				uri.metrics.waited(time.Since(tm))
+				index, used = uri.shared.index, &uri.shared.quotaUsed
+			} else {
+				used = &uri.quotaUsed
+				err := uri.localLockIndex()
+				if err != nil {
+					return err
+				}
+				defer os.Remove(uri.path + "/" + LOCKFILE)
+				index, err = uri.allIndex()
+				if err != nil {
+					return err
+				}
+			}
+			_, has := index[hash]
+			if uri.shared != nil {
+				uri.metrics.dedup(has)
+			}
+			if !has {
+				if *used == nil {
+					*used = make(map[string]int64)
+				}
+				err := uri.checkQuotaBlock(index, len(data), *used)
+				if err != nil {
+					return err
+				}
+			}
+			path, fn := blockPath(hash)
+			path = uri.path + "/" + path
+			os.MkdirAll(path, 0755)
+			err := ioutil.WriteFile(path+"/"+fn, data, 0644)
+			if err != nil {
+				return err
+			}
+			index[hash] = len(data)
+			if !has && uri.shared != nil && uri.shared.stats != nil {
+				// new block is not referenced by files yet
+				st := uri.shared.stats
+				st.Blocks++
+				st.Physical += int64(len(data))
+				st.Unreferenced += int64(len(data))
+			}
+			return uri.localWriteIndex(index)
+		}
+
+	case "mirror":
+		return uri.mirrorAll(func(r *URI) error { return r.putBlockID(hash, data) })
+
+	case "ec":
+		return uri.ecPutBlock(idAlgo(hash), data)
+
+	default:
+		return errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+// hasBlocks returns size of blocks which are stored
+func (uri *URI) hasBlocks(hashes []string) (map[string]int, error) {
+	remote := uri.proto == "ssh" || uri.proto == "tls"
+	if remote && uri.stdin == nil {
+		uri.open()
+	}
+	if remote && uri.has("hasBlocks") {
+		ret, err := uri.runRemote("hasBlocks", []byte(strings.Join(hashes, "\n")))
+		if err != nil {
+			return nil, err
+		}
+		index := make(map[string]int)
+		for _, line := range strings.Split(string(ret), "\n") {
+			ts := strings.Split(line, " ")
+			if len(ts) != 2 {
+				continue
+			}
+			index[ts[0]], _ = strconv.Atoi(ts[1])
+		}
+		return index, nil
+	}
+
+	all, err := uri.allIndex()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for _, hash := range hashes {
+		sz, ok := all[hash]
+		if ok {
+			index[hash] = sz
+		}
+		uri.metrics.dedup(ok)
+	}
+	return index, nil
+}
+
+func (uri *URI) rm(flags []string) ([]byte, error) {
+	switch uri.proto {
+	case "ssh", "tls":
+		ret, err := uri.runRemote("rm", []byte(strings.Join(flags, "\n")))
+		if errors.Is(err, ErrUncertain) {
+			// send again only when files are not removed, else names are unknown
+			ls, lerr := uri.getIndex(flags)
+			if lerr != nil || len(getFiles(strings.Split(string(ls), "\n"))) == 0 {
+				return nil, err
+			}
+			ret, err = uri.runRemote("rm", []byte(strings.Join(flags, "\n")))
+		}
+		return ret, err
+
+	case "file":
+		{
+			files, err := uri.localListFiles(flags)
+			if err != nil {
+				return nil, err
+			}
+			ret := ""
+			var names []string
+			var size int64
+			for _, file := range files {
+				os.Remove(uri.path + "/" + file.name + ".idx")
+				ret += fmt.Sprintf("%s removed\n", file.name)
+				names = append(names, file.name)
+				size += file.size
+			}
+			if len(names) > 0 {
+				uri.filesChanged()
+				uri.audit("rm", names, size)
+			}
+			return []byte(ret), nil
+		}
+
+	case "mirror", "ec":
+		return uri.mirrorRm(flags)
+
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+func (uri *URI) stats(flags []string) ([]byte, error) {
+	switch uri.proto {
+	case "ssh", "tls":
+		return uri.runRemote("stats", []byte(strings.Join(flags, "\n")))
+
+	case "file", "mirror", "ec":
+		{
+			// --json is passed from client
+			asJSON := false
+			var filter []string
+			for _, f := range flags {
+				if f == "--json" {
+					asJSON = true
+				} else {
+					filter = append(filter, f)
+				}
+			}
+
+			ret, err := uri.getIndex(nil)
+			if err != nil {
+				return nil, err
+			}
+			all := getFiles(strings.Split(string(ret), "\n"))
+			ret, err = uri.getIndex(filter)
+			if err != nil {
+				return nil, err
+			}
+			sel := getFiles(strings.Split(string(ret), "\n"))
+			index, err := uri.allIndex()
+			if err != nil {
+				return nil, err
+			}
+			st := fileStats(all, sel, index)
+			if asJSON {
+				return []byte(st.json()), nil
+			}
+			return []byte(st.text()), nil
+		}
+
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+// log returns records of audit log
+func (uri *URI) log(flags []string) ([]byte, error) {
+	switch uri.proto {
+	case "ssh", "tls":
+		return uri.runRemote("log", []byte(strings.Join(flags, "\n")))
+
+	case "file":
+		return uri.localLog(flags)
+
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+// quota returns usage and quotas of store
+func (uri *URI) quota(flags []string) ([]byte, error) {
+	switch uri.proto {
+	case "ssh", "tls":
+		return uri.runRemote("quota", []byte(strings.Join(flags, "\n")))
+
+	case "file":
+		usages, err := uri.localQuota()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range flags {
+			if f == "--json" {
+				return []byte(quotaJSON(usages)), nil
+			}
+		}
+		return []byte(quotaText(usages)), nil
+
+	default:
+		return nil, errors.New(uri.proto + NOSUPPORT)
+	}
+}
+
+func (uri *URI) remote() {
+	// set by forced command of ssh authorized_keys, like BFST_USER=ci ./bfst .
+	ident := ""
+	if user := os.Getenv("BFST_USER"); user != "" {
+		ident = "user:" + user
+	}
+	uri.serveConn(os.Stdin, os.Stdout, ident)
+}
+
+// serveConn runs commands of one client
+func (uri *URI) serveConn(r io.Reader, w io.Writer, ident string) {
+	// features agreed by hello, none for 1.0 clients
+	features := map[string]string{}
+
+	err := uri.authorize(ident)
+	if err != nil && err != ErrPermission {
+		fmt.Fprintln(os.Stderr, "E:", err.Error())
+	}
+
+	fr := &frameReader{r: r}
+	write := func(data []byte) {
+		limit := smallFrame
+		if _, ok := features["bigframe"]; ok {
+			limit, _ = strconv.Atoi(features["maxframe"])
+		}
+		if len(data) > limit {
+			data = []byte(fmt.Sprintf("E: reply %v: %d bytes", ErrFrameTooLarge, len(data)))
+		}
+		if fr.crc {
+			w.Write(crcFrame(data))
+		} else {
+			w.Write(append(frameHeader(len(data)), data...))
+		}
+	}
+
+	write([]byte(BFST_HELLO))
+
+	//fmt.Fprintln(os.Stderr, "!after hello")
+	for {
+		data, err := fr.next(maxRequest)
+		if errors.Is(err, ErrFrameChecksum) || errors.Is(err, ErrFrameTooLarge) && fr.crc {
+			// request is rejected, crc frames are found by magic
+			uri.metrics.rejected("", "invalid", len(data))
+			write([]byte("E: " + err.Error()))
+			continue
+		}
+		if errors.Is(err, ErrFrameTooLarge) {
+			// data of plain frame is not read, stream is out of sync
+			uri.metrics.rejected("", "invalid", 0)
+			write([]byte("E: " + err.Error()))
+			break
+		}
+		if err != nil {
+			// read of idle client is interrupted by shutdown
+			if ne, ok := err.(net.Error); err != io.EOF && !(ok && ne.Timeout()) {
+				fmt.Fprintln(os.Stderr, "E:", err.Error())
+			}
+			//fmt.Fprintln(os.Stderr, "!exit loop")
+			break
+		}
+		if len(data) == 0 || len(data) < int(data[0])+1 {
+			uri.metrics.rejected("", "invalid", len(data))
+			write([]byte("E: invalid command"))
+			continue
+		}
+		n := int(data[0]) + 1
+		cmd := string(data[1:n])
+		data = data[n:]
+
+		//fmt.Fprintf(os.Stderr, "!read %s %d\n", cmd, len(data))
+
+		err = uri.allow(cmd, data)
+		if err != nil {
+			uri.metrics.rejected(cmd, "denied", len(data))
+			write([]byte("E: " + err.Error()))
+			continue
+		}
+		err = validRequest(cmd, data)
+		if err != nil {
+			uri.metrics.rejected(cmd, "invalid", len(data))
+			write([]byte("E: " + err.Error()))
+			continue
+		}
+
+		var bs []byte
+		start := time.Now()
+		switch cmd {
+		case "ls":
+			bs, err = uri.ls(strings.Split(string(data), "\n"))
+		case "getIndex":
+			bs, err = uri.getIndex(strings.Split(string(data), "\n"))
+		case "putIndex":
+			err = uri.putIndex(strings.Split(string(data), "\n"))
+		case "getBlock":
+			err = uri.allowBlock(string(data))
+			if err == nil {
+				bs, err = uri.getBlock(string(data))
+			}
+		case "putBlock":
+			err = uri.putBlock(data)
+		case "putBlockID":
+			n := bytes.IndexByte(data, '\n')
+			err = checkBlock(string(data[:n]), data[n+1:])
+			if err == nil {
+				err = uri.putBlockID(string(data[:n]), data[n+1:])
+			}
+		case "rm":
+			bs, err = uri.rm(strings.Split(string(data), "\n"))
+		case "stats":
+			bs, err = uri.stats(strings.Split(string(data), "\n"))
+		case "quota":
+			bs, err = uri.quota(strings.Split(string(data), "\n"))
+		case "log":
+			bs, err = uri.log(strings.Split(string(data), "\n"))
+		case "index":
+			var index map[string]int
+			index, err = uri.allIndex()
+			if err == nil {
+				index, err = uri.visibleIndex(index)
+			}
+			for hash, sz := range index {
+				bs = append(bs, fmt.Sprintf("%s %d\n", hash, sz)...)
+			}
+		case "hello":
+			bs, features, err = remoteHello(data)
+			if err == nil {
+				bs = append(bs, "\nhash "+uri.hashAlgo()...)
+			}
+		case "auth":
+			bs, err = uri.auth(string(data))
+		case "hasBlocks":
+			var index map[string]int
+			index, err = uri.hasBlocks(strings.Split(string(data), "\n"))
+			if err == nil {
+				index, err = uri.visibleIndex(index)
+			}
+			for hash, sz := range index {
+				bs = append(bs, fmt.Sprintf("%s %d\n", hash, sz)...)
+			}
+		default:
+			err = errors.New("invalid command " + cmd)
+		}
+
+		uri.metrics.request(cmd, err, len(data), len(bs), time.Since(start))
+
+		//fmt.Fprintf(os.Stderr, "!write %d %v\n", len(bs), err)
+		if err != nil {
+			write([]byte("E: " + err.Error()))
+		} else {
+			write(bs)
+		}
+
+		// frames after hello reply
+		if _, ok := features["crc"]; ok && cmd == "hello" {
+			fr.crc = true
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// output of a command line command, it is text or JSON Lines with --json.
+// JSON results go to stdout and events go to stderr. Library prints nothing.
+type output int
+
+const (
+	noOutput output = iota
+	textOutput
+	jsonOutput
+)
+
+type fileJSON struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	MTime  string `json:"mtime"`
+	Blocks int    `json:"blocks"`
+	Hash   string `json:"hash"`
+}
+
+type transferJSON struct {
+	fileJSON
+	Bytes   int64 `json:"bytes"`
+	Deduped int64 `json:"deduped"`
+}
+
+type removedJSON struct {
+	Name    string `json:"name"`
+	Removed bool   `json:"removed"`
+}
+
+type eventJSON struct {
+	Event string `json:"event"`
+	Op    string `json:"op"`
+	*Progress
+}
+
+type initJSON struct {
+	Store string `json:"store"`
+	Hash  string `json:"hash,omitempty"`
+}
+
+type errorJSON struct {
+	Event string `json:"event"`
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error"`
+}
+
+func printJSON(f *os.File, v interface{}) {
+	bs, _ := json.Marshal(v)
+	f.Write(append(bs, '\n'))
+}
+
+func newFileJSON(fi *fileInfo) fileJSON {
+	return fileJSON{fi.name, fi.size, fi.mtime.Format(time.RFC3339), len(fi.blocks), fileHash(fi)}
+}
+
+// printFile prints result of a transferred file in json mode
+func (o output) printFile(fi *fileInfo, p *Progress) {
+	if o != jsonOutput {
+		return
+	}
+	ret := transferJSON{fileJSON: newFileJSON(fi)}
+	if p != nil {
+		ret.Bytes = p.Bytes
+		ret.Deduped = p.Deduped
+	}
+	printJSON(os.Stdout, ret)
+}
+
+// printResult prints output of remote command, JSON lines go to stdout
+func (o output) printResult(bs []byte) {
+	switch o {
+	case textOutput:
+		print(string(bs))
+	case jsonOutput:
+		os.Stdout.Write(bs)
+	}
+}
+
+// printRemoved prints output of rm
+func (o output) printRemoved(bs []byte) {
+	if o != jsonOutput {
+		o.printResult(bs)
+		return
+	}
+	for _, line := range strings.Split(string(bs), "\n") {
+		if strings.HasSuffix(line, " removed") {
+			printJSON(os.Stdout, removedJSON{strings.TrimSuffix(line, " removed"), true})
+		}
+	}
+}
+
+// printError prints error of one file, the command continues with other files
+func (o output) printError(name string, err error) {
+	switch o {
+	case textOutput:
+		println("E:", name, err.Error())
+	case jsonOutput:
+		printJSON(os.Stderr, errorJSON{"error", name, err.Error()})
+	}
+}
+
+// printFatal prints error which stops the command
+func (o output) printFatal(err error) {
+	switch o {
+	case textOutput:
+		println("E:", err.Error())
+	case jsonOutput:
+		printJSON(os.Stderr, errorJSON{Event: "error", Error: err.Error()})
+	}
+}
+
+// printStatus prints step of a command in text mode
+func (o output) printStatus(msg string) {
+	if o == textOutput {
+		println(msg)
+	}
+}
+
+// printWarning prints error which is recovered, it is Warn of command line
+func (o output) printWarning(msg string) {
+	switch o {
+	case textOutput:
+		println("W:", msg)
+	case jsonOutput:
+		printJSON(os.Stderr, errorJSON{Event: "warning", Error: msg})
+	}
+}
+
+// progressEnd ends progress line
+func (o output) progressEnd() {
+	if o == textOutput {
+		println("")
+	}
+}
+
+func (o output) putProgress(p *Progress) {
+	switch o {
+	case textOutput:
+		fmt.Printf("\r%s %d+%d/%d  ", p.Name, p.Skipped, p.Done-p.Skipped, p.Blocks)
+	case jsonOutput:
+		printJSON(os.Stderr, eventJSON{"progress", "put", p})
+	}
+}
+
+func (o output) getProgress(p *Progress) {
+	switch o {
+	case textOutput:
+		fmt.Printf("\r%s %d/%d  ", p.Name, p.Done, p.Blocks)
+	case jsonOutput:
+		printJSON(os.Stderr, eventJSON{"progress", "get", p})
+	}
+}
+
+// initProgress shows directory i of 256 and blocks found by init in text mode
+func (o output) initProgress(i, blocks int) {
+	if o == textOutput {
+		fmt.Printf("\rinit=%d count=%d  ", i, blocks)
+	}
+}
+
+// printDone prints event of a finished command whose result is not JSON, like cat
+func (o output) printDone(op string, p *Progress) {
+	if o == jsonOutput {
+		printJSON(os.Stderr, eventJSON{"done", op, p})
+	}
+}
@@ -0,0 +1,267 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const QUOTAFILE = "quota"
+
+var ErrQuota = errors.New("quota exceeded")
+
+// quota is a line of quota file in store, 0 is unlimited
+//
+//	# prefix  physical  logical
+//	*         100G      1T
+//	ci-       50G       -
+//
+// * is whole store, physical of a prefix is size of blocks used by its files.
+type quota struct {
+	prefix            string
+	physical, logical int64
+}
+
+type quotaUsage struct {
+	quota
+	usedPhysical, usedLogical int64
+}
+
+func readQuota(path string) ([]*quota, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*quota
+	for i, line := range strings.Split(string(bs), "\n") {
+		ts := strings.Fields(line)
+		if len(ts) == 0 || ts[0][0] == '#' {
+			continue
+		}
+		if len(ts) != 3 {
+			return nil, fmt.Errorf("%s:%d: invalid line", path, i+1)
+		}
+		q := &quota{prefix: ts[0]}
+		for j, p := range []*int64{&q.physical, &q.logical} {
+			if ts[j+1] == "-" {
+				continue
+			}
+			*p, err = parseSize(ts[j+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, i+1, err.Error())
+			}
+		}
+		ret = append(ret, q)
+	}
+	return ret, nil
+}
+
+func (q *quota) match(name string) bool {
+	return q.prefix == "*" || strings.HasPrefix(name, q.prefix)
+}
+
+// usage returns physical and logical bytes of quota
+func (q *quota) usage(files []*fileInfo, index map[string]int) (physical, logical int64) {
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if !q.match(file.name) {
+			continue
+		}
+		logical += file.size
+		for _, hash := range file.blocks {
+			if !seen[hash] {
+				seen[hash] = true
+				physical += int64(index[hash])
+			}
+		}
+	}
+	if q.prefix == "*" {
+		// unreferenced blocks use space too
+		physical = 0
+		for _, sz := range index {
+			physical += int64(sz)
+		}
+	}
+	return
+}
+
+func (q *quota) exceeded(kind string, used, limit int64) error {
+	return fmt.Errorf("%w: %s %s %d > %d", ErrQuota, q.prefix, kind, used, limit)
+}
+
+// quotaFiles returns quotas and all files of store, quotas are nil without quota file
+func (uri *URI) quotaFiles() ([]*quota, []*fileInfo, error) {
+	quotas, err := readQuota(uri.path + "/" + QUOTAFILE)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// quota counts files which are not visible to client, index file is read
+	// as shared index may be locked by checkQuotaBlock
+	all := *uri
+	all.client, all.shared = nil, nil
+	files, err := all.localListFiles(nil)
+	return quotas, files, err
+}
+
+// checkQuotaBlock checks physical quotas before a new block is added to index,
+// which is locked by caller. Blocks of a client with name prefix count for the
+// quotas of its names. used caches their usage with blocks which are not in
+// files yet, it is added the size of the block.
+func (uri *URI) checkQuotaBlock(index map[string]int, size int, used map[string]int64) error {
+	quotas, err := readQuota(uri.path + "/" + QUOTAFILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if uri.client != nil && uri.client.grant != nil {
+		prefix = uri.client.grant.prefix
+	}
+	var files []*fileInfo
+	var matched []*quota
+	for _, q := range quotas {
+		if q.physical == 0 {
+			continue
+		}
+		var physical int64
+		if q.prefix == "*" {
+			physical, _ = q.usage(nil, index)
+		} else if prefix != "" && strings.HasPrefix(prefix, q.prefix) {
+			var ok bool
+			physical, ok = used[q.prefix]
+			if !ok {
+				if files == nil {
+					_, files, err = uri.quotaFiles()
+					if err != nil {
+						return err
+					}
+				}
+				physical, _ = q.usage(files, index)
+				used[q.prefix] = physical
+			}
+			matched = append(matched, q)
+		} else {
+			continue
+		}
+		if physical+int64(size) > q.physical {
+			return q.exceeded("physical", physical+int64(size), q.physical)
+		}
+	}
+	for _, q := range matched {
+		used[q.prefix] += int64(size)
+	}
+	return nil
+}
+
+// checkQuotaFile checks quotas before file replaces file of same name
+func (uri *URI) checkQuotaFile(fi *fileInfo, index map[string]int) error {
+	quotas, files, err := uri.quotaFiles()
+	if quotas == nil || err != nil {
+		return err
+	}
+	var after []*fileInfo
+	for _, file := range files {
+		if file.name != fi.name {
+			after = append(after, file)
+		}
+	}
+	after = append(after, fi)
+	for _, q := range quotas {
+		if !q.match(fi.name) {
+			continue
+		}
+		// files which become smaller are allowed over quota
+		p0, l0 := q.usage(files, index)
+		p1, l1 := q.usage(after, index)
+		if q.physical > 0 && p1 > q.physical && p1 > p0 {
+			return q.exceeded("physical", p1, q.physical)
+		}
+		if q.logical > 0 && l1 > q.logical && l1 > l0 {
+			return q.exceeded("logical", l1, q.logical)
+		}
+	}
+	return nil
+}
+
+// filesChanged drops cached usage of checkQuotaBlock, visible blocks and stats after
+// files are added or removed
+func (uri *URI) filesChanged() {
+	uri.quotaUsed = nil
+	if uri.client != nil {
+		uri.client.visible = nil
+	}
+	if uri.shared != nil {
+		uri.shared.mu.Lock()
+		uri.shared.quotaUsed = nil
+		uri.shared.changes++
+		uri.shared.stats = nil
+		uri.shared.mu.Unlock()
+	}
+}
+
+// localQuota returns usage of each quota
+func (uri *URI) localQuota() ([]*quotaUsage, error) {
+	quotas, files, err := uri.quotaFiles()
+	if err != nil {
+		return nil, err
+	}
+	index, err := uri.allIndex()
+	if err != nil {
+		return nil, err
+	}
+	if quotas == nil {
+		// usage of store without quota
+		quotas = []*quota{{prefix: "*"}}
+		files, err = uri.localListFiles(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ret []*quotaUsage
+	for _, q := range quotas {
+		u := &quotaUsage{quota: *q}
+		u.usedPhysical, u.usedLogical = q.usage(files, index)
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+func quotaText(usages []*quotaUsage) string {
+	size := func(n int64) string {
+		if n == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d", n)
+	}
+	ret := fmt.Sprintf("%-12s %-14s %-14s %-14s %s\n", "prefix", "physical", "quota", "logical", "quota")
+	for _, u := range usages {
+		ret += fmt.Sprintf("%-12s %-14d %-14s %-14d %s\n", u.prefix, u.usedPhysical, size(u.physical), u.usedLogical, size(u.logical))
+	}
+	return ret
+}
+
+type quotaUsageJSON struct {
+	Prefix        string `json:"prefix"`
+	Physical      int64  `json:"physical"`
+	PhysicalQuota int64  `json:"physical_quota,omitempty"`
+	Logical       int64  `json:"logical"`
+	LogicalQuota  int64  `json:"logical_quota,omitempty"`
+}
+
+// quotaJSON returns JSON line of each quota, unlimited quota is omitted
+func quotaJSON(usages []*quotaUsage) string {
+	ret := ""
+	for _, u := range usages {
+		bs, _ := json.Marshal(quotaUsageJSON{u.prefix, u.usedPhysical, u.physical, u.usedLogical, u.logical})
+		ret += string(bs) + "\n"
+	}
+	return ret
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileReader reads a stored file at any offset, only needed blocks are read
+type fileReader struct {
+	uri  *URI
+	fi   *fileInfo
+	offs []int64 // of data of blocks
+	size int64
+	ctx  context.Context // of Client.Open, nil for cat
+
+	// last read block, reads are serialized because uri has one connection
+	mu   sync.Mutex
+	last int
+	data []byte
+}
+
+// newFileReader returns reader of verified file fi, index has sizes of its blocks
+func (uri *URI) newFileReader(fi *fileInfo, index map[string]int) (*fileReader, error) {
+	err := uri.verify(fi)
+	if err != nil {
+		return nil, err
+	}
+	r := &fileReader{uri: uri, fi: fi, last: -1}
+	var off int64
+	for _, hash := range fi.blocks {
+		sz, ok := index[hash]
+		if !ok {
+			return nil, errors.New("unknown block " + hash)
+		}
+		r.offs = append(r.offs, off)
+		off += uri.plainSize(int64(sz), 1)
+	}
+	if off != uri.plainSize(fi.size, len(fi.blocks)) {
+		return nil, errors.New("size not equal")
+	}
+	r.size = off
+	return r, nil
+}
+
+// stat returns stored file name
+func (uri *URI) stat(name string) (*fileInfo, error) {
+	ret, err := uri.getIndex([]string{nameFilter(name)})
+	if err != nil {
+		return nil, err
+	}
+	files := getFiles(strings.Split(string(ret), "\n"))
+	if len(files) != 1 {
+		return nil, fmt.Errorf("%s %w", name, ErrNotFound)
+	}
+	return files[0], nil
+}
+
+// openFile returns reader of stored file name, its manifest is verified
+func (uri *URI) openFile(name string) (*fileReader, error) {
+	fi, err := uri.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := uri.allIndex()
+	if err != nil {
+		return nil, err
+	}
+	return uri.newFileReader(fi, index)
+}
+
+func (r *fileReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt, it is safe for concurrent use. ctx of reader is
+// checked before each block, a running request ends by timeout of uri.
+func (r *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n < len(p) && off < r.size {
+		if r.ctx != nil && r.ctx.Err() != nil {
+			return n, r.ctx.Err()
+		}
+		i := sort.Search(len(r.offs), func(i int) bool { return r.offs[i] > off }) - 1
+		if i != r.last {
+			data, err := r.uri.readBlock(r.fi.blocks[i])
+			if err != nil {
+				return n, err
+			}
+			r.last = i
+			r.data = data
+		}
+		c := copy(p[n:], r.data[off-r.offs[i]:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// parseRange parses off:len, negative off is counted from end of file, empty len reads to end
+func parseRange(str string, size int64) (off, n int64, err error) {
+	ts := strings.Split(str, ":")
+	if len(ts) != 2 {
+		return 0, 0, errors.New("invalid range " + str)
+	}
+	off, err = strconv.ParseInt(ts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("invalid range " + str)
+	}
+	if off < 0 {
+		off += size
+		if off < 0 {
+			off = 0
+		}
+	}
+	if off > size {
+		off = size
+	}
+	n = size - off
+	if ts[1] != "" {
+		n, err = strconv.ParseInt(ts[1], 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid range " + str)
+		}
+		if off+n > size {
+			n = size - off
+		}
+	}
+	return
+}
+
+// cmdCat writes stored file or part of it to stdout
+func (uri *URI) cmdCat(args []string) error {
+	rng := ""
+	if len(args) == 3 && args[0] == "--range" {
+		rng = args[1]
+		args = args[2:]
+	}
+	if len(args) != 1 {
+		return errors.New("cat [--range off:len] file")
+	}
+
+	r, err := uri.openFile(args[0])
+	if err != nil {
+		return err
+	}
+	off, n := int64(0), r.Size()
+	if rng != "" {
+		off, n, err = parseRange(rng, r.Size())
+		if err != nil {
+			return err
+		}
+	}
+	n, err = io.Copy(os.Stdout, io.NewSectionReader(r, off, n))
+	if err != nil {
+		return err
+	}
+	uri.out.printDone("cat", &Progress{Name: r.fi.name, Size: r.Size(), Blocks: len(r.fi.blocks), Bytes: n})
+	return nil
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// ErrUncertain is returned when reply of a request which is not idempotent is lost
+var ErrUncertain = errors.New("request may be applied, reply is lost")
+
+// idempotent commands are sent again when reply is lost, the result is same
+var idempotent = map[string]bool{
+	"ls":         true,
+	"getIndex":   true,
+	"getBlock":   true,
+	"putBlock":   true,
+	"putBlockID": true,
+	"stats":      true,
+	"hasBlocks":  true,
+	"index":      true,
+	"quota":      true,
+	"log":        true,
+}
+
+type retryPolicy struct {
+	retries    int           // failures before giving up
+	backoff    time.Duration // delay after first failure, doubled after each failure
+	maxBackoff time.Duration
+	timeout    time.Duration // reply timeout, it restarts when reply data arrives
+	minRate    int64         // timeout is extended by payload size / minRate
+	hello      time.Duration // BFST_HELLO timeout
+}
+
+var defaultRetry = retryPolicy{
+	retries:    10,
+	backoff:    time.Second,
+	maxBackoff: time.Minute,
+	timeout:    time.Minute,
+	minRate:    64 << 10,
+	hello:      5 * time.Second,
+}
+
+func (uri *URI) retryPolicy() *retryPolicy {
+	if uri.retry == nil {
+		rp := defaultRetry
+		uri.retry = &rp
+	}
+	return uri.retry
+}
+
+// delay returns backoff delay after n failures, half of it is random
+func (rp *retryPolicy) delay(n int) time.Duration {
+	d := rp.backoff
+	for i := 1; i < n && d < rp.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// replyTimeout returns timeout of command with payload bytes in request and reply
+func (rp *retryPolicy) replyTimeout(cmd string, size int) time.Duration {
+	if cmd == "getBlock" {
+		size += BLOCKSIZE
+	}
+	if rp.minRate <= 0 {
+		return rp.timeout
+	}
+	return rp.timeout + time.Duration(float64(size)/float64(rp.minRate)*float64(time.Second))
+}
+
+// configure sets a retry key from config file
+func (rp *retryPolicy) configure(k, v string) error {
+	var err error
+	switch k {
+	case "retries":
+		rp.retries, err = strconv.Atoi(v)
+	case "retry-backoff":
+		rp.backoff, err = time.ParseDuration(v)
+	case "retry-max-backoff":
+		rp.maxBackoff, err = time.ParseDuration(v)
+	case "timeout":
+		rp.timeout, err = time.ParseDuration(v)
+	case "min-rate":
+		rp.minRate, err = parseSize(v)
+	case "hello-timeout":
+		rp.hello, err = time.ParseDuration(v)
+	}
+	if err == nil && (rp.retries < 1 || rp.backoff < 0 || rp.maxBackoff < 0 || rp.timeout <= 0 || rp.minRate < 0 || rp.hello <= 0) {
+		err = errors.New("out of range")
+	}
+	if err != nil {
+		return errors.New("invalid " + k + " " + v)
+	}
+	return nil
+}
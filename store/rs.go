@@ -0,0 +1,178 @@
+package store
+
+import (
+	"errors"
+)
+
+// Reed-Solomon coding over GF(2^8), polynomial 0x11d
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMulAdd does out ^= c * in
+func gfMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	var mt [256]byte
+	for i := 1; i < 256; i++ {
+		mt[i] = gfMul(c, byte(i))
+	}
+	for i, b := range in {
+		out[i] ^= mt[b]
+	}
+}
+
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	a := make([][]byte, n)
+	inv := make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte{}, m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && a[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errors.New("singular matrix")
+		}
+		a[c], a[p] = a[p], a[c]
+		inv[c], inv[p] = inv[p], inv[c]
+
+		f := gfInv(a[c][c])
+		for j := 0; j < n; j++ {
+			a[c][j] = gfMul(a[c][j], f)
+			inv[c][j] = gfMul(inv[c][j], f)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || a[r][c] == 0 {
+				continue
+			}
+			f = a[r][c]
+			for j := 0; j < n; j++ {
+				a[r][j] ^= gfMul(f, a[c][j])
+				inv[r][j] ^= gfMul(f, inv[c][j])
+			}
+		}
+	}
+	return inv, nil
+}
+
+type rsCodec struct {
+	k, m   int
+	matrix [][]byte
+}
+
+// newRS creates a systematic codec with k data shards and m parity shards
+func newRS(k, m int) (*rsCodec, error) {
+	if k < 1 || m < 0 || k+m > 256 {
+		return nil, errors.New("invalid shard count")
+	}
+	// vandermonde matrix, any k rows are independent
+	vm := make([][]byte, k+m)
+	for r := range vm {
+		vm[r] = make([]byte, k)
+		for c := 0; c < k; c++ {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+	// make top k rows identity, so data shards are stored as they are
+	top, err := gfInvert(vm[:k])
+	if err != nil {
+		return nil, err
+	}
+	rs := &rsCodec{k: k, m: m, matrix: make([][]byte, k+m)}
+	for r := range vm {
+		rs.matrix[r] = make([]byte, k)
+		for c := 0; c < k; c++ {
+			var v byte
+			for i := 0; i < k; i++ {
+				v ^= gfMul(vm[r][i], top[i][c])
+			}
+			rs.matrix[r][c] = v
+		}
+	}
+	return rs, nil
+}
+
+// encode fills parity shards from data shards, all shards have same size
+func (rs *rsCodec) encode(shards [][]byte) {
+	for p := rs.k; p < rs.k+rs.m; p++ {
+		for i := range shards[p] {
+			shards[p][i] = 0
+		}
+		for c := 0; c < rs.k; c++ {
+			gfMulAdd(rs.matrix[p][c], shards[c], shards[p])
+		}
+	}
+}
+
+// reconstruct rebuilds missing (nil) data shards, at least k shards are needed
+func (rs *rsCodec) reconstruct(shards [][]byte) error {
+	var rows [][]byte
+	var avail [][]byte
+	for i, shard := range shards {
+		if shard != nil && len(avail) < rs.k {
+			rows = append(rows, rs.matrix[i])
+			avail = append(avail, shard)
+		}
+	}
+	if len(avail) < rs.k {
+		return errors.New("not enough shards")
+	}
+	inv, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+	for c := 0; c < rs.k; c++ {
+		if shards[c] != nil {
+			continue
+		}
+		shard := make([]byte, len(avail[0]))
+		for i := range avail {
+			gfMulAdd(inv[c][i], avail[i], shard)
+		}
+		shards[c] = shard
+	}
+	return nil
+}
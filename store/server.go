@@ -0,0 +1,268 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const TLS_PORT = "7700"
+
+// sharedIndex is index of a store served to many clients
+type sharedIndex struct {
+	mu    sync.Mutex
+	index map[string]int
+	// quotaUsed is usage of prefix quotas of checkQuotaBlock, nil when files changed
+	quotaUsed map[string]int64
+	// changes counts changes of files, visible blocks of clients are computed again
+	changes int
+	// stats of /metrics, nil when files changed
+	stats *storeStats
+}
+
+func (s *sharedIndex) copy() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := make(map[string]int, len(s.index))
+	for k, v := range s.index {
+		index[k] = v
+	}
+	return index
+}
+
+// server accepts clients of one store until it is closed
+type server struct {
+	uri   *URI
+	ln    net.Listener
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	done  bool
+}
+
+func (s *server) serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			done := s.done
+			s.mu.Unlock()
+			if done {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				// panic of one client does not stop the other clients
+				if r := recover(); r != nil {
+					fmt.Fprintf(os.Stderr, "E: %s: panic: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+				}
+				conn.Close()
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			// each client has own URI, index is shared
+			uri := *s.uri
+			ident, err := clientIdent(conn)
+			if err == nil {
+				uri.serveConn(conn, conn, ident)
+			}
+		}()
+	}
+}
+
+// clientIdent returns identity of verified client certificate
+func clientIdent(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	err := tc.Handshake()
+	if err != nil {
+		return "", err
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	return "cert:" + certs[0].Subject.CommonName, nil
+}
+
+// shutdown stops accepting, running requests are finished before clients are closed
+func (s *server) shutdown() {
+	s.mu.Lock()
+	s.done = true
+	s.ln.Close()
+	for conn := range s.conns {
+		// idle clients wait for request, it is interrupted
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// cmdServe serves a file store over TLS
+//
+//	bfst serve --listen :7700 --store /data --cert cert.pem --key key.pem [--client-ca ca.pem] [--metrics :9770] [--insecure]
+//
+// Without access file of store serve only starts with --insecure, all clients are admin then.
+func cmdServe(args []string) error {
+	listen := ":" + TLS_PORT
+	path := "."
+	var certFile, keyFile, caFile, metricsAddr string
+	insecure := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--insecure" {
+			insecure = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return errors.New("serve needs value of " + args[i])
+		}
+		switch args[i] {
+		case "--listen":
+			listen = args[i+1]
+		case "--store":
+			path = args[i+1]
+		case "--cert":
+			certFile = args[i+1]
+		case "--key":
+			keyFile = args[i+1]
+		case "--client-ca":
+			caFile = args[i+1]
+		case "--metrics":
+			metricsAddr = args[i+1]
+		default:
+			return errors.New("unknown option " + args[i])
+		}
+		i++
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("serve needs --cert and --key")
+	}
+	if _, err := os.Stat(path + "/" + ACCESSFILE); err != nil {
+		if !insecure {
+			return errors.New("no " + ACCESSFILE + " file in store, use --insecure to allow all clients")
+		}
+		Warn("no " + ACCESSFILE + " file, all clients are admin")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	uri := parseURI("file:" + path)
+	index, err := uri.allIndex()
+	if err != nil {
+		return err
+	}
+	uri.shared = &sharedIndex{index: index}
+	uri.metrics = newMetrics()
+
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		// identity of client certificate is cert:CN in access file
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate in " + caFile)
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	ln, err := tls.Listen("tcp", listen, conf)
+	if err != nil {
+		return err
+	}
+	s := &server{uri: uri, ln: ln, conns: make(map[net.Conn]bool)}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		println("shutdown")
+		s.shutdown()
+	}()
+	if metricsAddr != "" {
+		// plain http, like other Prometheus exporters
+		go func() {
+			err := http.ListenAndServe(metricsAddr, uri.metricsHandler())
+			Warn("metrics: " + err.Error())
+		}()
+	}
+	println("serve", uri.str(), "on", listen)
+	err = s.serve()
+	s.wg.Wait()
+	return err
+}
+
+func (uri *URI) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{ServerName: uri.host}
+	if uri.cert != "" {
+		cert, err := tls.LoadX509KeyPair(uri.cert, uri.key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if uri.ca != "" {
+		pem, err := ioutil.ReadFile(uri.ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in " + uri.ca)
+		}
+	}
+	return conf, nil
+}
+
+// dialTLS connects bfst serve, frames of in are sent and received frames are written to out
+func (uri *URI) dialTLS(in io.Reader, out io.Writer) error {
+	conf, err := uri.tlsConfig()
+	if err != nil {
+		return err
+	}
+	port := uri.port
+	if port == "" {
+		port = TLS_PORT
+	}
+	dialer := &net.Dialer{Timeout: uri.retryPolicy().hello}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(uri.host, port), conf)
+	if err != nil {
+		// close() waits for in to be read
+		go io.Copy(ioutil.Discard, in)
+		return err
+	}
+	go func() {
+		_, err := io.Copy(conn, in)
+		conn.CloseWrite()
+		if err != nil {
+			io.Copy(ioutil.Discard, in)
+		}
+	}()
+	_, err = io.Copy(out, conn)
+	conn.Close()
+	return err
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type sizeCount struct {
+	Max   int64 `json:"max"`
+	Count int   `json:"count"`
+}
+
+type fileStat struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Exclusive int64  `json:"exclusive"`
+}
+
+type storeStats struct {
+	Files        int         `json:"files"`
+	Logical      int64       `json:"logical"`
+	Physical     int64       `json:"physical"`
+	Blocks       int         `json:"blocks"`
+	Referenced   int64       `json:"referenced"`
+	Unreferenced int64       `json:"unreferenced"`
+	Ratio        float64     `json:"dedup_ratio"`
+	Shared       int64       `json:"shared"`
+	SharedBlocks int         `json:"shared_blocks"`
+	Sizes        []sizeCount `json:"block_sizes"`
+	Selected     []fileStat  `json:"selected"`
+	Freed        int64       `json:"unreferenced_by_rm"`
+}
+
+// fileStats reports space usage of a store.
+// all is every file of the store, sel is the files matching filter.
+func fileStats(all, sel []*fileInfo, index map[string]int) *storeStats {
+	st := &storeStats{Files: len(all), Blocks: len(index)}
+
+	// count files referencing each block
+	refs := make(map[string]int)
+	for _, file := range all {
+		st.Logical += file.size
+		seen := make(map[string]bool)
+		for _, hash := range file.blocks {
+			if !seen[hash] {
+				seen[hash] = true
+				refs[hash]++
+			}
+		}
+	}
+
+	hist := make(map[int]int)
+	for hash, sz := range index {
+		st.Physical += int64(sz)
+		bits := 0
+		for (1 << uint(bits)) < sz {
+			bits++
+		}
+		hist[bits]++
+		if n := refs[hash]; n > 0 {
+			st.Referenced += int64(sz)
+			if n > 1 {
+				st.SharedBlocks++
+				st.Shared += int64(sz)
+			}
+		}
+	}
+	st.Unreferenced = st.Physical - st.Referenced
+	if st.Referenced > 0 {
+		st.Ratio = float64(st.Logical) / float64(st.Referenced)
+	}
+
+	var keys []int
+	for bits := range hist {
+		keys = append(keys, bits)
+	}
+	sort.Ints(keys)
+	for _, bits := range keys {
+		st.Sizes = append(st.Sizes, sizeCount{int64(1) << uint(bits), hist[bits]})
+	}
+
+	// bytes which are only referenced by selected files
+	selRefs := make(map[string]int)
+	for _, file := range sel {
+		fs := fileStat{Name: file.name, Size: file.size}
+		seen := make(map[string]bool)
+		for _, hash := range file.blocks {
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			selRefs[hash]++
+			if refs[hash] == 1 {
+				fs.Exclusive += int64(index[hash])
+			}
+		}
+		st.Selected = append(st.Selected, fs)
+	}
+	for hash, n := range selRefs {
+		if n == refs[hash] {
+			st.Freed += int64(index[hash])
+		}
+	}
+	return st
+}
+
+func (st *storeStats) text() string {
+	ret := fmt.Sprintf("files        %d\n", st.Files)
+	ret += fmt.Sprintf("logical      %d\n", st.Logical)
+	ret += fmt.Sprintf("physical     %d in %d blocks\n", st.Physical, st.Blocks)
+	ret += fmt.Sprintf("referenced   %d\n", st.Referenced)
+	ret += fmt.Sprintf("unreferenced %d\n", st.Unreferenced)
+	if st.Referenced > 0 {
+		ret += fmt.Sprintf("dedup ratio  %.2f\n", st.Ratio)
+	}
+	ret += fmt.Sprintf("shared       %d in %d blocks\n", st.Shared, st.SharedBlocks)
+
+	ret += "block size   count\n"
+	for _, sc := range st.Sizes {
+		ret += fmt.Sprintf("<=%-10d %d\n", sc.Max, sc.Count)
+	}
+
+	ret += fmt.Sprintf("%-12s %-12s %s\n", "size", "exclusive", "name")
+	for _, fs := range st.Selected {
+		ret += fmt.Sprintf("%-12d %-12d %s\n", fs.Size, fs.Exclusive, fs.Name)
+	}
+	ret += fmt.Sprintf("rm of %d files unreferences %d\n", len(st.Selected), st.Freed)
+	return ret
+}
+
+func (st *storeStats) json() string {
+	bs, _ := json.Marshal(st)
+	return string(bs) + "\n"
+}
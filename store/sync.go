@@ -0,0 +1,119 @@
+package store
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// nameFilter returns a filter which matches exactly one file name
+func nameFilter(name string) string {
+	return "/^" + regexp.QuoteMeta(name) + "$/"
+}
+
+func sameBlocks(a, b *fileInfo) bool {
+	if a.size != b.size || len(a.blocks) != len(b.blocks) {
+		return false
+	}
+	for i := range a.blocks {
+		if a.blocks[i] != b.blocks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cmdSync copies files matching filter from src to dst, only blocks missing in dst are transferred
+func cmdSync(src, dst *URI, filter []string, del bool) error {
+	ret, err := src.getIndex(filter)
+	if err != nil {
+		return errors.New("source: " + err.Error())
+	}
+	files := getFiles(strings.Split(string(ret), "\n"))
+
+	ret, err = dst.getIndex(filter)
+	if err != nil {
+		return errors.New("destination: " + err.Error())
+	}
+	dfiles := make(map[string]*fileInfo)
+	for _, file := range getFiles(strings.Split(string(ret), "\n")) {
+		dfiles[file.name] = file
+	}
+
+	// only blocks of changed files are looked up
+	var hashes []string
+	for _, file := range files {
+		if dfile, ok := dfiles[file.name]; !ok || !sameBlocks(file, dfile) {
+			hashes = append(hashes, file.blocks...)
+		}
+	}
+	index, err := dst.hasBlocks(hashes)
+	if err != nil {
+		return errors.New("destination: " + err.Error())
+	}
+
+	names := make(map[string]bool)
+	for _, file := range files {
+		names[file.name] = true
+		if dfile, ok := dfiles[file.name]; ok && sameBlocks(file, dfile) {
+			continue
+		}
+
+		p := &Progress{Name: file.name, Size: file.size, Blocks: len(file.blocks)}
+		for _, hash := range file.blocks {
+			if sz, has := index[hash]; has {
+				p.Skipped++
+				p.Deduped += int64(sz)
+			} else {
+				bs, err := src.getBlock(hash)
+				if err != nil {
+					dst.out.progressEnd()
+					return errors.New("read block " + hash + ": " + err.Error())
+				}
+				src.limiter.wait(len(bs))
+				err = checkBlock(hash, bs)
+				if err != nil {
+					dst.out.progressEnd()
+					return err
+				}
+				// block keeps its id when destination has another hash,
+				// so manifest and signature of file stay valid
+				err = dst.putBlockID(hash, bs)
+				if err != nil {
+					dst.out.progressEnd()
+					return errors.New("write block " + hash + ": " + err.Error())
+				}
+				if dst.limiter != src.limiter {
+					// limiter of --limit-rate is shared, block is charged once
+					dst.limiter.wait(len(bs))
+				}
+				index[hash] = len(bs)
+				p.Bytes += int64(len(bs))
+			}
+			p.Done++
+			dst.out.putProgress(p)
+		}
+		dst.out.progressEnd()
+
+		err = dst.putIndex(strings.Split(strings.TrimSuffix(file.index(), "\n"), "\n"))
+		if err != nil {
+			return errors.New(file.name + ": " + err.Error())
+		}
+		dst.out.printFile(file, p)
+	}
+
+	if !del {
+		return nil
+	}
+	for name := range dfiles {
+		if names[name] {
+			continue
+		}
+		bs, err := dst.rm([]string{nameFilter(name)})
+		if err != nil {
+			return err
+		}
+		dst.out.printRemoved(bs)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// limits of requests to remote bfst
+const (
+	maxName    = 250
+	maxRequest = 256 << 20
+	maxFilters = 1000
+	maxFilter  = 1000
+)
+
+var ErrInvalidHash = errors.New("invalid hash")
+
+// validName checks name of stored file, it is a file name in store directory
+func validName(name string) error {
+	if name == "" || len(name) > maxName || name[0] == '.' || strings.Contains(name, "..") {
+		return fmt.Errorf("%q %w", name, ErrInvalidName)
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || c == ' ' || c == '/' || c == '\\' {
+			return fmt.Errorf("%q %w", name, ErrInvalidName)
+		}
+	}
+	return nil
+}
+
+// validHash checks id of block, it is a path in store directory
+func validHash(hash string) error {
+	if idAlgo(hash) == "" {
+		return fmt.Errorf("%q %w", hash, ErrInvalidHash)
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return fmt.Errorf("%q %w", hash, ErrInvalidHash)
+		}
+	}
+	return nil
+}
+
+// validFilters checks filters of names, regexps must compile
+func validFilters(flags []string) error {
+	if len(flags) > maxFilters {
+		return errors.New("too many filters")
+	}
+	for _, f := range flags {
+		if len(f) > maxFilter {
+			return errors.New("filter too long")
+		}
+		if f == "" {
+			continue
+		}
+		if _, err := filterRegexp(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validIndex checks lines of putIndex, name size mtime and block hashes
+func validIndex(lines []string) error {
+	if len(lines) < 2 || len(indexBlocks(lines[1:])) == 0 {
+		return errors.New("not enough input lines")
+	}
+	ts := strings.Split(lines[0], " ")
+	if len(ts) != 3 {
+		return errors.New("file head error")
+	}
+	err := validName(ts[0])
+	if err != nil {
+		return err
+	}
+	err = validManifest(lines[1:])
+	if err != nil {
+		return err
+	}
+	for _, hash := range indexBlocks(lines[1:]) {
+		err = validHash(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validRequest checks request of remote command before it is run
+func validRequest(cmd string, data []byte) error {
+	switch cmd {
+	case "ls", "getIndex", "rm", "stats", "log":
+		return validFilters(strings.Split(string(data), "\n"))
+	case "putIndex":
+		return validIndex(strings.Split(string(data), "\n"))
+	case "getBlock":
+		return validHash(string(data))
+	case "putBlock":
+		if len(data) > BLOCKSIZE {
+			return fmt.Errorf("block of %d bytes is too large", len(data))
+		}
+	case "putBlockID":
+		n := bytes.IndexByte(data, '\n')
+		if n < 0 {
+			return ErrInvalidHash
+		}
+		err := validHash(string(data[:n]))
+		if err != nil {
+			return err
+		}
+		return validRequest("putBlock", data[n+1:])
+	case "hasBlocks":
+		for _, hash := range strings.Split(string(data), "\n") {
+			if hash == "" {
+				continue
+			}
+			err := validHash(hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}